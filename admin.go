@@ -0,0 +1,279 @@
+package gwi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/gorilla/mux"
+)
+
+var (
+	ErrInvalidName  = errors.New("invalid name")
+	ErrRepoExists   = errors.New("repository already exists")
+	ErrRepoNotFound = errors.New("repository not found")
+	ErrUnknownUser  = errors.New("unknown user")
+)
+
+// trashDir is the folder under Root where deleted repositories are moved to.
+const trashDir = ".trash"
+
+// validName checks a name of user, group, repository or thread, "-"
+// separates repositories from actions on paths.
+func validName(name string) bool {
+	return name != "" && name != "-" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// validNamespace checks a user followed by groups separated by slashes.
+func validNamespace(namespace string) bool {
+	for _, name := range strings.Split(namespace, "/") {
+		if !validName(name) {
+			return false
+		}
+	}
+	return true
+}
+
+func validBranch(name string) bool {
+	return name != "" &&
+		!strings.HasPrefix(name, "/") && !strings.HasSuffix(name, "/") &&
+		!strings.HasPrefix(name, "-") && !strings.HasSuffix(name, ".lock") &&
+		!strings.Contains(name, "..") && !strings.Contains(name, "//") &&
+		!strings.ContainsAny(name, " ~^:?*[\\")
+}
+
+// repoName returns the folder of the repository repo of user, repo may or
+// may not have the .git suffix, as the folder. Missing repositories are
+// named without it.
+func repoName(root, user, repo string) string {
+	base := strings.TrimSuffix(repo, ".git")
+	if base == "" {
+		return repo
+	}
+	for _, name := range []string{base, base + ".git"} {
+		if _, err := os.Stat(path.Join(root, user, name)); err == nil {
+			return name
+		}
+	}
+	return base
+}
+
+func (g *Gwi) repoDir(user, repo string) (string, error) {
+	if !validNamespace(user) || !validName(repo) {
+		return "", ErrInvalidName
+	}
+
+	dir := path.Join(g.config.Root, user, repoName(g.config.Root, user, repo))
+	if _, err := os.Stat(dir); err != nil {
+		return dir, ErrRepoNotFound
+	}
+	return dir, nil
+}
+
+// CreateRepo initializes a bare repository for user, HEAD points to branch,
+// which is also set as the default branch on the repository config.
+func (g *Gwi) CreateRepo(user, repo, branch string) error {
+	dir, err := g.repoDir(user, repo)
+	if err == nil {
+		return ErrRepoExists
+	}
+	if err != ErrRepoNotFound {
+		return err
+	}
+	if branch == "" {
+		branch = "main"
+	}
+	if !validBranch(branch) {
+		return ErrInvalidName
+	}
+	ref := plumbing.NewBranchReferenceName(branch)
+
+	if err := os.MkdirAll(dir, os.ModeDir|0o700); err != nil {
+		return err
+	}
+	r, err := git.PlainInit(dir, true)
+	if err != nil {
+		return err
+	}
+	h := plumbing.NewSymbolicReference(plumbing.HEAD, ref)
+	if err := r.Storer.SetReference(h); err != nil {
+		return err
+	}
+	cfg, err := r.Config()
+	if err != nil {
+		return err
+	}
+	cfg.Init.DefaultBranch = branch
+	return r.Storer.SetConfig(cfg)
+}
+
+// SetDescription writes the description file of the repository.
+func (g *Gwi) SetDescription(user, repo, desc string) error {
+	dir, err := g.repoDir(user, repo)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(dir, "description"), []byte(desc), 0o600)
+}
+
+// SetHead changes the default branch of the repository, the branch must
+// exist.
+func (g *Gwi) SetHead(user, repo, branch string) error {
+	dir, err := g.repoDir(user, repo)
+	if err != nil {
+		return err
+	}
+	if !validBranch(branch) {
+		return ErrInvalidName
+	}
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+
+	ref := plumbing.NewBranchReferenceName(branch)
+	if _, err := r.Reference(ref, false); err != nil {
+		return err
+	}
+	return r.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, ref))
+}
+
+// RenameRepo changes the name of a repository.
+func (g *Gwi) RenameRepo(user, repo, name string) error {
+	return g.moveRepo(user, repo, user, name)
+}
+
+// TransferRepo moves a repository to another user, keeping its name.
+func (g *Gwi) TransferRepo(user, repo, to string) error {
+	if g.vault != nil && g.vault.GetUser(to) == nil {
+		return ErrUnknownUser
+	}
+	return g.moveRepo(user, repo, to, repo)
+}
+
+func (g *Gwi) moveRepo(user, repo, toUser, toRepo string) error {
+	from, err := g.repoDir(user, repo)
+	if err != nil {
+		return err
+	}
+	to, err := g.repoDir(toUser, toRepo)
+	if err == nil {
+		return ErrRepoExists
+	}
+	if err != ErrRepoNotFound {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(to), os.ModeDir|0o700); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	repos.invalidate(from)
+	dropIndex(from)
+	dropIndex(to)
+	g.relinkForks(from, to)
+	return nil
+}
+
+// DeleteRepo moves a repository to the trash directory under Root, so it
+// can still be recovered by the administrator.
+func (g *Gwi) DeleteRepo(user, repo string) error {
+	dir, err := g.repoDir(user, repo)
+	if err != nil {
+		return err
+	}
+
+	trash := path.Join(g.config.Root, trashDir, user)
+	if err := os.MkdirAll(trash, os.ModeDir|0o700); err != nil {
+		return err
+	}
+	g.relinkForks(dir, "")
+	repos.invalidate(dir)
+	dropIndex(dir)
+	id := make([]byte, 4)
+	rand.Read(id)
+	name := fmt.Sprintf("%s-%d.%s", repo, time.Now().UnixNano(), hex.EncodeToString(id))
+	return os.Rename(dir, path.Join(trash, name))
+}
+
+// authenticate checks the HTTP Basic credentials of the request against the
+// vault, on failure it writes the response and returns false.
+func (g *Gwi) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	login, pass, ok := r.BasicAuth()
+	if !ok || login == "" || pass == "" {
+		w.Header().Set("WWW-Authenticate", "Basic")
+		w.WriteHeader(http.StatusUnauthorized)
+		return "", false
+	}
+	if g.vault == nil || !g.vault.Validate(login, pass) {
+		http.Error(w, "invalid login", http.StatusUnauthorized)
+		return "", false
+	}
+	return login, true
+}
+
+// authorize authenticates the request and checks that the login is the
+// owner of the repositories of namespace.
+func (g *Gwi) authorize(w http.ResponseWriter, r *http.Request, namespace string) bool {
+	login, ok := g.authenticate(w, r)
+	if !ok {
+		return false
+	}
+	if owner(namespace) != login {
+		http.Error(w, "invalid repo", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// adminHandler runs administrative actions on repositories, it only accepts
+// POST requests authenticated as the owner of the repository. Arguments are
+// passed as form values.
+func (g *Gwi) adminHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	slog.Debug("running admin handler", "vars", vars)
+
+	user, repo := vars["user"], vars["repo"]
+	if !g.authorize(w, r, user) {
+		return
+	}
+
+	var err error
+	switch vars["action"] {
+	case "create":
+		err = g.CreateRepo(user, repo, r.FormValue("branch"))
+	case "desc":
+		err = g.SetDescription(user, repo, r.FormValue("description"))
+	case "head":
+		err = g.SetHead(user, repo, r.FormValue("branch"))
+	case "private":
+		err = g.SetPrivate(user, repo, r.FormValue("private") != "false")
+	case "rename":
+		err = g.RenameRepo(user, repo, r.FormValue("name"))
+	case "transfer":
+		err = g.TransferRepo(user, repo, r.FormValue("user"))
+	case "delete":
+		err = g.DeleteRepo(user, repo)
+	default:
+		http.Error(w, "unknown action", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		repoError(w, vars["action"], err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,111 @@
+package gwi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_Admin(t *testing.T) {
+	root := t.TempDir()
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(login, repo, action string, form url.Values) int {
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"/x/"+repo+"/admin/"+action,
+			strings.NewReader(form.Encode()),
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(login, "1234")
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	steps := []struct {
+		login, repo, action string
+		form                url.Values
+		code                int
+	}{
+		{"y", "proj", "create", nil, http.StatusUnauthorized},
+		{"x", "proj", "create", url.Values{"branch": {"trunk"}}, http.StatusNoContent},
+		{"x", "proj", "create", nil, http.StatusConflict},
+		{"x", "proj", "desc", url.Values{"description": {"my project"}}, http.StatusNoContent},
+		{"x", "proj", "head", url.Values{"branch": {"dev"}}, http.StatusNotFound},
+		{"x", "proj", "rename", url.Values{"name": {"../y"}}, http.StatusBadRequest},
+		{"x", "proj", "rename", url.Values{"name": {"app"}}, http.StatusNoContent},
+		{"x", "app", "transfer", url.Values{"user": {"z"}}, http.StatusBadRequest},
+		{"x", "app", "transfer", url.Values{"user": {"y"}}, http.StatusNoContent},
+		{"x", "app", "delete", nil, http.StatusNotFound},
+	}
+	for _, s := range steps {
+		if code := do(s.login, s.repo, s.action, s.form); code != s.code {
+			t.Errorf("%s %s: got %d, want %d", s.action, s.repo, code, s.code)
+		}
+	}
+
+	dir := path.Join(root, "y", "app")
+	if desc := readDesc(dir); desc != "my project" {
+		t.Errorf("desc is %q", desc)
+	}
+	head, _ := os.ReadFile(path.Join(dir, "HEAD"))
+	if string(head) != "ref: refs/heads/trunk\n" {
+		t.Errorf("HEAD is %q", head)
+	}
+
+	if err := g.DeleteRepo("y", "app"); err != nil {
+		t.Fatal(err)
+	}
+	// a repository created again with the same name is kept apart
+	if err := g.CreateRepo("y", "app", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.DeleteRepo("y", "app"); err != nil {
+		t.Fatal(err)
+	}
+	trash, _ := os.ReadDir(path.Join(root, trashDir, "y"))
+	if len(trash) != 2 || !strings.HasPrefix(trash[0].Name(), "app-") || !strings.HasPrefix(trash[1].Name(), "app-") {
+		t.Errorf("unexpected trash %v", trash)
+	}
+}
+
+func Test_CreateOnPush(t *testing.T) {
+	root := t.TempDir()
+	g, err := NewFromConfig(Config{Root: root}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	advertise := func(login, pass, repo string) int {
+		req := httptest.NewRequest(http.MethodGet, "/x/"+repo+"/info/refs?service=git-receive-pack", nil)
+		if login != "" {
+			req.SetBasicAuth(login, pass)
+		}
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, tt := range []struct{ login, pass string }{{"", ""}, {"x", "wrong"}, {"y", "1234"}} {
+		if code := advertise(tt.login, tt.pass, "team/proj"); code != http.StatusUnauthorized {
+			t.Errorf("%s:%s: got %d", tt.login, tt.pass, code)
+		}
+	}
+	if _, err := os.Stat(path.Join(root, "x")); !os.IsNotExist(err) {
+		t.Fatalf("unauthorized push touched the disk: %v", err)
+	}
+	if code := advertise("x", "1234", "team/proj"); code != http.StatusOK {
+		t.Errorf("owner: got %d", code)
+	}
+	if !isRepo(path.Join(root, "x", "team", "proj")) {
+		t.Error("push did not create x/team/proj")
+	}
+}
@@ -0,0 +1,310 @@
+package gwi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/gorilla/mux"
+)
+
+var (
+	ErrNoPatches        = errors.New("thread has no patches")
+	ErrIncompleteSeries = errors.New("patch series is incomplete")
+)
+
+// ConflictError is returned when a patch of a series does not apply, Index
+// is the position of the patch in the series, starting at 1.
+type ConflictError struct {
+	Index   int
+	Total   int
+	Subject string
+	Err     error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("patch %d/%d %q does not apply: %s", e.Index, e.Total, e.Subject, e.Err)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyThread applies the latest patch series sent on a thread, in order, to
+// branch, creating one commit per patch, see [latestSeries]. Authors and
+// dates are taken from the patches, and committer is used as committer. If
+// branch is empty the branch HEAD points to is used. Nothing is changed if
+// any patch fails to apply, in that case the error is a [ConflictError]. It
+// returns the new branch head.
+func (g *Gwi) ApplyThread(user, repo, thread, branch string, committer object.Signature) (plumbing.Hash, error) {
+	dir, err := g.repoDir(user, repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	refName := plumbing.NewBranchReferenceName(branch)
+	if branch == "" {
+		head, err := r.Storer.Reference(plumbing.HEAD)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		refName = head.Target()
+	} else if !validBranch(branch) {
+		return plumbing.ZeroHash, ErrInvalidName
+	}
+	ref, err := r.Reference(refName, true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	commit, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	mails, err := readMails(dir, thread)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	patches, err := latestSeries(mails)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	parent := commit
+	for i, p := range patches {
+		tree, err := parent.Tree()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		pt := newPatchTree(tree)
+		if err := pt.apply(p); err != nil {
+			return plumbing.ZeroHash, &ConflictError{
+				Index:   i + 1,
+				Total:   len(patches),
+				Subject: p.Subject,
+				Err:     err,
+			}
+		}
+
+		treeHash, _, err := writeTree(r.Storer, tree, pt.changes)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		parent, err = writeCommit(r, p, treeHash, parent.Hash, committer)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	newRef := plumbing.NewHashReference(refName, parent.Hash)
+	if err := r.Storer.CheckAndSetReference(newRef, ref); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	slog.Info("applied patches", "repo", dir, "thread", thread, "branch", refName, "head", parent.Hash)
+
+	g.refsUpdated(user, repo, []*packp.Command{{Name: refName, Old: ref.Hash(), New: parent.Hash}})
+	return parent.Hash, nil
+}
+
+// latestSeries returns the patches of the highest version of the series sent
+// on a thread, ordered by their number. A patch sent again replaces the
+// previous one with the same number, and patches sent in replies are
+// ignored. All patches of the series must have been sent.
+func latestSeries(mails []Mail) ([]*Patch, error) {
+	version := 0
+	for _, m := range mails {
+		for _, p := range m.Patches {
+			version = max(version, p.Version)
+		}
+	}
+	if version == 0 {
+		return nil, ErrNoPatches
+	}
+
+	numbered := map[int]*Patch{}
+	total := 0
+	for _, m := range mails {
+		for _, p := range m.Patches {
+			if p.Version == version {
+				numbered[p.Number] = p
+				total = p.Total
+			}
+		}
+	}
+	series := make([]*Patch, 0, total)
+	for i := 1; i <= total; i++ {
+		p, ok := numbered[i]
+		if !ok {
+			return nil, fmt.Errorf("%w: v%d misses patch %d/%d", ErrIncompleteSeries, version, i, total)
+		}
+		series = append(series, p)
+	}
+	return series, nil
+}
+
+func writeCommit(r *git.Repository, p *Patch, tree, parent plumbing.Hash, committer object.Signature) (*object.Commit, error) {
+	author := object.Signature{Name: p.Author, Email: p.Email, When: p.Date}
+	if author.Email == "" {
+		author.Name, author.Email = committer.Name, committer.Email
+	}
+	if author.Name == "" {
+		author.Name = author.Email
+	}
+	if author.When.IsZero() {
+		author.When = committer.When
+	}
+
+	msg := p.Subject + "\n"
+	if p.Message != "" {
+		msg += "\n" + p.Message + "\n"
+	}
+	commit := &object.Commit{
+		Author:       author,
+		Committer:    committer,
+		Message:      msg,
+		TreeHash:     tree,
+		ParentHashes: []plumbing.Hash{parent},
+	}
+
+	obj := r.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return nil, err
+	}
+	hash, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	return r.CommitObject(hash)
+}
+
+// writeTree stores a copy of tree with changes, given by path, applied. It
+// returns the hash of the new tree and whether it is empty. Tree may be nil.
+func writeTree(s storer.EncodedObjectStorer, tree *object.Tree, changes map[string]*fileChange) (plumbing.Hash, bool, error) {
+	entries := map[string]object.TreeEntry{}
+	if tree != nil {
+		for _, e := range tree.Entries {
+			entries[e.Name] = e
+		}
+	}
+
+	subdirs := map[string]map[string]*fileChange{}
+	for name, c := range changes {
+		dir, rest, nested := strings.Cut(name, "/")
+		if nested {
+			if subdirs[dir] == nil {
+				subdirs[dir] = map[string]*fileChange{}
+			}
+			subdirs[dir][rest] = c
+			continue
+		}
+
+		if c.content == nil {
+			delete(entries, name)
+			continue
+		}
+		obj := s.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+		w, err := obj.Writer()
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+		if _, err := w.Write([]byte(*c.content)); err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+		w.Close()
+		hash, err := s.SetEncodedObject(obj)
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+		entries[name] = object.TreeEntry{Name: name, Mode: c.mode, Hash: hash}
+	}
+
+	for dir, subChanges := range subdirs {
+		var sub *object.Tree
+		if e, ok := entries[dir]; ok && e.Mode == filemode.Dir {
+			t, err := object.GetTree(s, e.Hash)
+			if err != nil {
+				return plumbing.ZeroHash, false, err
+			}
+			sub = t
+		}
+		hash, empty, err := writeTree(s, sub, subChanges)
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+		if empty {
+			delete(entries, dir)
+			continue
+		}
+		entries[dir] = object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: hash}
+	}
+
+	newTree := &object.Tree{}
+	for _, e := range entries {
+		newTree.Entries = append(newTree.Entries, e)
+	}
+	sort.Slice(newTree.Entries, func(i, j int) bool {
+		return sortName(newTree.Entries[i]) < sortName(newTree.Entries[j])
+	})
+
+	obj := s.NewEncodedObject()
+	if err := newTree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	hash, err := s.SetEncodedObject(obj)
+	return hash, len(newTree.Entries) == 0, err
+}
+
+// sortName gives the name git uses to sort tree entries, directories are
+// compared as if they had a trailing slash.
+func sortName(e object.TreeEntry) string {
+	if e.Mode == filemode.Dir {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+// applyHandler applies the patches of the thread given on the path to the
+// branch given on the form, only the owner of the repository can do it.
+func (g *Gwi) applyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	slog.Debug("running apply handler", "vars", vars)
+
+	user, repo := vars["user"], vars["repo"]
+	if !g.authorize(w, r, user) {
+		return
+	}
+
+	committer := object.Signature{Name: owner(user), When: time.Now()}
+	if u := g.vault.GetUser(owner(user)); u != nil {
+		committer.Email = u.Email()
+	}
+
+	head, err := g.ApplyThread(user, repo, vars["thread"], r.FormValue("branch"), committer)
+	var conflict *ConflictError
+	switch {
+	case err == nil:
+		http.Redirect(w, r, "/"+user+"/"+repo+"/-/log?ref="+head.String(), http.StatusSeeOther)
+	case errors.As(err, &conflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrNoPatches), errors.Is(err, ErrIncompleteSeries):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		repoError(w, "apply", err)
+	}
+}
@@ -0,0 +1,199 @@
+package gwi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_Apply(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	base := testCommit(t, repo, map[string]string{
+		"README":   "hello\nworld\n",
+		"src/a.go": "package src\n",
+	}, "init")
+	repoDir := path.Join(root, "x", "proj")
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []string{testPatch1, testPatch2} {
+		if err := saveMail(repoDir, "series", []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := saveMail(repoDir, "conflict", []byte(testPatchConflict)); err != nil {
+		t.Fatal(err)
+	}
+
+	apply := func(login, thread string) int {
+		form := url.Values{"branch": {"main"}}
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"/x/proj/apply/"+thread,
+			strings.NewReader(form.Encode()),
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(login, "1234")
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := apply("y", "series"); code != http.StatusUnauthorized {
+		t.Errorf("apply by other user: got %d", code)
+	}
+	if code := apply("x", "conflict"); code != http.StatusConflict {
+		t.Errorf("apply conflict: got %d", code)
+	}
+	if head, _ := repo.Head(); head.Hash() != base {
+		t.Fatal("branch changed by failed apply")
+	}
+	if code := apply("x", "series"); code != http.StatusSeeOther {
+		t.Fatalf("apply series: got %d", code)
+	}
+
+	head, _ := repo.Head()
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Message != "Add main\n\nWith a body.\n" {
+		t.Errorf("unexpected message %q", commit.Message)
+	}
+	if commit.Author.Email != "a@b.c" || commit.Author.When.Unix() != 1792359718 {
+		t.Errorf("unexpected author %+v", commit.Author)
+	}
+	if commit.Committer.Email != "x@localhost" {
+		t.Errorf("unexpected committer %+v", commit.Committer)
+	}
+
+	parent, err := commit.Parent(0)
+	if err != nil || parent.Message != "Add there\n" || parent.ParentHashes[0] != base {
+		t.Errorf("unexpected parent %v %v", parent, err)
+	}
+
+	tree, _ := commit.Tree()
+	files := map[string]string{
+		"README":   "hello\nthere\nworld\n!\n",
+		"main.go":  "package main\n",
+		"src/a.go": "package src\n",
+	}
+	for name, want := range files {
+		f, err := tree.File(name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if got, _ := f.Contents(); got != want {
+			t.Errorf("%s is %q", name, got)
+		}
+	}
+}
+
+func Test_PatchPaths(t *testing.T) {
+	diff := func(name string) string {
+		return "diff --git a/" + name + " b/" + name + "\n" +
+			"--- a/" + name + "\n" +
+			"+++ b/" + name + "\n" +
+			"@@ -1 +1 @@\n" +
+			"-a\n" +
+			"+b\n"
+	}
+
+	if _, err := parsePatch(diff("src/a.go"), nil); err != nil {
+		t.Errorf("src/a.go: %s", err)
+	}
+	for _, name := range []string{"a/../x", "../x", ".git/config", "src/.GIT/hooks/pre-commit", "/etc/passwd", "a//b", "./x", "a/."} {
+		if _, err := parsePatch(diff(name), nil); !errors.Is(err, ErrPatchPath) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+
+	rename := "diff --git a/x b/y\n" +
+		"similarity index 100%\n" +
+		"rename from x\n" +
+		"rename to ../y\n"
+	if _, err := parsePatch(rename, nil); !errors.Is(err, ErrPatchPath) {
+		t.Errorf("rename: got %v", err)
+	}
+}
+
+func Test_ApplySeries(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	testCommit(t, repo, map[string]string{"README": "hello\nworld\n"}, "init")
+	repoDir := path.Join(root, "x", "proj")
+
+	g, err := NewFromConfig(Config{Root: root}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := func(subject, from, to string) string {
+		return "From: Ann Dev <ann@localhost>\n" +
+			"Subject: " + subject + "\n" +
+			"\n" +
+			"diff --git a/README b/README\n" +
+			"--- a/README\n" +
+			"+++ b/README\n" +
+			"@@ -1,2 +1,2 @@\n" +
+			" hello\n" +
+			"-" + from + "\n" +
+			"+" + to + "\n"
+	}
+	thread := func(name string, mails ...string) {
+		for _, m := range mails {
+			if err := saveMail(repoDir, name, []byte(m)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	apply := func(thread string) int {
+		req := httptest.NewRequest(http.MethodPost, "/x/proj/apply/"+thread, nil)
+		req.SetBasicAuth("x", "1234")
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// the first version does not apply, the second is sent again and a
+	// reply suggests another change
+	thread("resent",
+		patch("[PATCH] Replace world", "planet", "earth"),
+		patch("[PATCH v2] Replace world", "world", "moon"),
+		patch("Re: [PATCH v2] Replace world", "world", "sun"),
+		patch("[PATCH v2] Replace world", "world", "earth"),
+	)
+	thread("incomplete", patch("[PATCH v3 2/2] Replace world", "earth", "moon"))
+
+	if code := apply("incomplete"); code != http.StatusBadRequest {
+		t.Errorf("incomplete series: got %d", code)
+	}
+	if code := apply("resent"); code != http.StatusSeeOther {
+		t.Fatalf("resent series: got %d", code)
+	}
+
+	head, _ := repo.Head()
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent, err := commit.Parent(0); err != nil || parent.Message != "init" {
+		t.Errorf("more than one patch applied: %v %v", parent, err)
+	}
+	f, err := commit.File("README")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := f.Contents(); got != "hello\nearth\n" {
+		t.Errorf("README is %q", got)
+	}
+}
@@ -0,0 +1,225 @@
+package gwi
+
+import (
+	"container/list"
+	"html/template"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// repoCacheSize is the number of repositories kept in memory, memoSize the
+// number of results memoized for each of them and idleRepos the number of
+// opened copies of each kept for the next requests.
+const (
+	repoCacheSize = 128
+	memoSize      = 4096
+	idleRepos     = 4
+)
+
+// repos caches opened repositories and the results computed from them, the
+// least recently used is evicted when the cache is full.
+var repos = newRepoCache(repoCacheSize)
+
+// repoEntry holds the opened copies of a repository that no request is
+// using, and the results computed from it. go-git repositories are not safe
+// for concurrent use, so each request takes a copy of its own and gives it
+// back when it is done, only results are shared. Results are keyed by commit
+// hash, as commits never change, but they are dropped along with the copies
+// when the references of the repository are updated.
+type repoEntry struct {
+	dir string
+
+	mu    sync.Mutex
+	idle  []*git.Repository
+	memo  map[string]any
+	stale bool
+}
+
+// cachedRepo is a repository opened for one request along with the results
+// memoized for it, it must be closed when the request is done.
+type cachedRepo struct {
+	*git.Repository
+	*repoEntry
+}
+
+type repoCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newRepoCache(size int) *repoCache {
+	return &repoCache{size: size, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// open returns a copy of the repository at dir that no other request is
+// using, it is only opened if there is none in the cache.
+func (c *repoCache) open(dir string) (*cachedRepo, error) {
+	e := c.entry(dir)
+	e.mu.Lock()
+	if n := len(e.idle); n > 0 {
+		repo := e.idle[n-1]
+		e.idle = e.idle[:n-1]
+		e.mu.Unlock()
+		return &cachedRepo{Repository: repo, repoEntry: e}, nil
+	}
+	e.mu.Unlock()
+
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedRepo{Repository: repo, repoEntry: e}, nil
+}
+
+// entry returns the cache entry of dir, creating it if needed.
+func (c *repoCache) entry(dir string) *repoEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[dir]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*repoEntry)
+	}
+	e := &repoEntry{dir: dir, memo: map[string]any{}}
+	c.items[dir] = c.order.PushFront(e)
+	for c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.items, last.Value.(*repoEntry).dir)
+	}
+	return e
+}
+
+// invalidate drops the copies and results of the repository at dir, it must
+// be called when its references change or when it is moved.
+func (c *repoCache) invalidate(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[dir]; ok {
+		c.order.Remove(e)
+		delete(c.items, dir)
+
+		entry := e.Value.(*repoEntry)
+		entry.mu.Lock()
+		entry.stale, entry.idle = true, nil
+		entry.mu.Unlock()
+	}
+}
+
+// close gives the repository back to the cache for the next request.
+func (r *cachedRepo) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.stale && len(r.idle) < idleRepos {
+		r.idle = append(r.idle, r.Repository)
+	}
+}
+
+// memoize returns the result stored under key, calling f to compute it the
+// first time. Results must be plain values, not objects read from the
+// repository, as those keep using the copy of the request that read them.
+func (r *repoEntry) memoize(key string, f func() any) any {
+	r.mu.Lock()
+	v, ok := r.memo[key]
+	r.mu.Unlock()
+	if ok {
+		return v
+	}
+
+	v = f()
+	r.mu.Lock()
+	if len(r.memo) >= memoSize {
+		r.memo = map[string]any{}
+	}
+	r.memo[key] = v
+	r.mu.Unlock()
+	return v
+}
+
+// commits counts the commits reachable from ref.
+func (g *Gwi) commits(repo *cachedRepo) func(ref plumbing.Hash) int {
+	return func(ref plumbing.Hash) int {
+		return repo.memoize("commits "+ref.String(), func() any {
+			slog.Debug("counting commits", "ref", ref.String())
+			iter, err := repo.Log(&git.LogOptions{From: ref})
+			if err != nil {
+				slog.Error("log", "error", err.Error())
+				return -1
+			}
+			defer iter.Close()
+
+			count := 0
+			iter.ForEach(func(*object.Commit) error {
+				count++
+				return nil
+			})
+			return count
+		}).(int)
+	}
+}
+
+// readme renders the README.md, or README, file of the commit ref.
+func (g *Gwi) readme(repo *cachedRepo) func(ref plumbing.Hash) template.HTML {
+	return func(ref plumbing.Hash) template.HTML {
+		return repo.memoize("readme "+ref.String(), func() any {
+			slog.Debug("rendering readme", "ref", ref.String())
+			commit, err := repo.CommitObject(ref)
+			if err != nil {
+				slog.Error("commit", "error", err.Error())
+				return template.HTML("")
+			}
+			for _, name := range []string{"README.md", "README"} {
+				f, err := commit.File(name)
+				if err != nil {
+					continue
+				}
+				content, err := f.Contents()
+				if err != nil {
+					slog.Error("contents", "error", err.Error(), "name", name)
+					continue
+				}
+				if name == "README" {
+					return template.HTML("<pre>" + template.HTMLEscapeString(content) + "</pre>")
+				}
+				return mdown(content)
+			}
+			return template.HTML("")
+		}).(template.HTML)
+	}
+}
+
+// lastcommit returns the last commit, reachable from ref, that changed the
+// file or folder at path.
+func (g *Gwi) lastcommit(repo *cachedRepo) func(ref plumbing.Hash, path string) *object.Commit {
+	return func(ref plumbing.Hash, path string) *object.Commit {
+		hash := repo.memoize("lastcommit "+ref.String()+" "+path, func() any {
+			slog.Debug("getting last commit", "ref", ref.String(), "path", path)
+			last := plumbing.ZeroHash
+			err := logCommits(repo.Repository, ref, path, time.Time{}, func(c *object.Commit) error {
+				last = c.Hash
+				return storer.ErrStop
+			})
+			if err != nil {
+				slog.Error("last commit", "error", err.Error())
+			}
+			return last
+		}).(plumbing.Hash)
+		if hash.IsZero() {
+			return nil
+		}
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			slog.Error("commit", "error", err.Error())
+			return nil
+		}
+		return commit
+	}
+}
@@ -0,0 +1,123 @@
+package gwi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+func Test_Cache(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		testRepo(t, root, "x", name)
+	}
+
+	c := newRepoCache(2)
+	a, err := c.open(path.Join(root, "x", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := c.open(path.Join(root, "x", "a"))
+	if again.repoEntry != a.repoEntry {
+		t.Error("results not cached")
+	}
+	if again.Repository == a.Repository {
+		t.Error("repository in use given to another request")
+	}
+	again.close()
+	if reused, _ := c.open(path.Join(root, "x", "a")); reused.Repository != again.Repository {
+		t.Error("closed repository not reused")
+	}
+	c.open(path.Join(root, "x", "b"))
+	c.open(path.Join(root, "x", "a"))
+	c.open(path.Join(root, "x", "c"))
+	if _, ok := c.items[path.Join(root, "x", "b")]; ok || c.order.Len() != 2 {
+		t.Error("least recently used repository not evicted")
+	}
+	c.invalidate(path.Join(root, "x", "a"))
+	a.close()
+	if again, _ := c.open(path.Join(root, "x", "a")); again.repoEntry == a.repoEntry || again.Repository == a.Repository {
+		t.Error("repository not invalidated")
+	}
+
+	calls := 0
+	for i := 0; i < 2; i++ {
+		a.memoize("key", func() any { calls++; return calls })
+	}
+	if calls != 1 {
+		t.Errorf("memoized function called %d times", calls)
+	}
+}
+
+func Test_Memoized(t *testing.T) {
+	root := t.TempDir()
+	repoDir := path.Join(root, "x", "proj")
+	repo := testRepo(t, root, "x", "proj")
+	first := testCommit(t, repo, map[string]string{"README.md": "# Hi\n", "src/a.go": "package src\n"}, "init")
+	second := testCommit(t, repo, map[string]string{"README.md": "# Hi\n", "src/a.go": "package src\n", "b": "b\n"}, "add b")
+
+	g := &Gwi{config: Config{Root: root}}
+	cached, err := repos.open(repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := g.files(cached)(second); n != 3 {
+		t.Errorf("files: %d", n)
+	}
+	if n := g.commits(cached)(second); n != 2 {
+		t.Errorf("commits: %d", n)
+	}
+	if html := g.readme(cached)(first); !strings.Contains(string(html), "<h1>Hi</h1>") {
+		t.Errorf("readme: %s", html)
+	}
+	if c := g.lastcommit(cached)(second, "src"); c == nil || c.Hash != first {
+		t.Errorf("last commit of src: %v", c)
+	}
+	if c := g.lastcommit(cached)(second, "b"); c == nil || c.Hash != second {
+		t.Errorf("last commit of b: %v", c)
+	}
+
+	g.refsUpdated("x", "proj", []*packp.Command{
+		{Name: plumbing.NewBranchReferenceName("main"), Old: first, New: second},
+	})
+	if again, _ := repos.open(repoDir); again.repoEntry == cached.repoEntry {
+		t.Error("repository not invalidated after push")
+	}
+}
+
+// Test_ConcurrentRequests reads one repository from many requests at once,
+// it is meant to be run with -race.
+func Test_ConcurrentRequests(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	testCommit(t, repo, map[string]string{"README.md": "# Hi\n"}, "init")
+	testCommit(t, repo, map[string]string{"README.md": "# Hi\n", "src/a.go": "package src\n"}, "add a")
+
+	g, err := NewFromConfig(Config{Root: root}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := []string{"/x/proj", "/x/proj/-/tree", "/x/proj/-/log", "/x/proj/-/raw/src/a.go", "/x/proj/-/zip", "/x/proj/info/refs", "/x"}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, url := range urls {
+				rec := httptest.NewRecorder()
+				g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("%s: %d", url, rec.Code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
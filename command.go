@@ -0,0 +1,156 @@
+package gwi
+
+import (
+	"bufio"
+	"net/mail"
+	"strings"
+	"time"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Command is an instruction sent by mail on a thread, as a line starting
+// with ! on the message body, e.g.:
+//
+//	!close
+//	!reopen
+//	!label bug
+//	!unlabel bug
+//	!apply [branch]
+//
+// Commands are only run if both the From header and the envelope sender of
+// the message are the address of the owner of the repository, that is, the
+// address given by the vault's [User.Email]. This is not authentication,
+// anyone can send mail with those addresses, so !apply, which writes to the
+// repository, also needs the message to come through one of the relays of
+// [Config.MailTrustedRelays], that are trusted to verify senders, e.g. by
+// checking DKIM or SPF, and to reject forged ones.
+type Command struct {
+	Name string
+	Args []string
+}
+
+// parseCommands returns the commands found on body, quoted lines are
+// ignored.
+func parseCommands(body string) []Command {
+	var cmds []Command
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "!") {
+			continue
+		}
+		fields := strings.Fields(line[1:])
+		if len(fields) == 0 {
+			continue
+		}
+		cmds = append(cmds, Command{Name: strings.ToLower(fields[0]), Args: fields[1:]})
+	}
+	return cmds
+}
+
+// mailAuthorized checks that from, the From header, and envelope, the
+// address given on MAIL FROM, are both the address of the owner of the
+// repository at repoDir. Both can be forged, see [Command].
+func (g *Gwi) mailAuthorized(repoDir, from, envelope string) bool {
+	if g.vault == nil {
+		return false
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return false
+	}
+
+	namespace, _ := g.repoPath(repoDir)
+	u := g.vault.GetUser(owner(namespace))
+	return u != nil && u.Email() != "" &&
+		strings.EqualFold(u.Email(), addr.Address) &&
+		strings.EqualFold(u.Email(), envelope)
+}
+
+// runCommands runs the commands found on a message received on thread,
+// envelope is its sender given on MAIL FROM and relayed tells whether it came
+// through a trusted relay.
+func (g *Gwi) runCommands(repoDir, thread string, m Mail, envelope string, relayed bool) {
+	cmds := parseCommands(m.Body)
+	if len(cmds) == 0 {
+		return
+	}
+	if !g.mailAuthorized(repoDir, m.From, envelope) {
+		slog.Info("commands rejected", "from", m.From, "envelope", envelope, "thread", thread)
+		return
+	}
+
+	state, err := readThreadState(repoDir, thread)
+	if err != nil {
+		slog.Error("thread state", "error", err.Error())
+		return
+	}
+	for _, c := range cmds {
+		slog.Info("running command", "command", c.Name, "args", c.Args, "thread", thread)
+		switch c.Name {
+		case "close":
+			state.Closed = true
+		case "reopen":
+			state.Closed = false
+		case "label":
+			for _, l := range c.Args {
+				if !state.hasLabel(l) {
+					state.Labels = append(state.Labels, l)
+				}
+			}
+		case "unlabel":
+			var labels []string
+			for _, l := range state.Labels {
+				if !contains(c.Args, l) {
+					labels = append(labels, l)
+				}
+			}
+			state.Labels = labels
+		case "apply":
+			if !relayed {
+				slog.Info("apply rejected, not from a trusted relay", "from", m.From, "thread", thread)
+				continue
+			}
+			branch := ""
+			if len(c.Args) > 0 {
+				branch = c.Args[0]
+			}
+			g.applyCommand(repoDir, thread, branch)
+		default:
+			slog.Info("unknown command", "command", c.Name)
+		}
+	}
+
+	if err := saveThreadState(repoDir, thread, state); err != nil {
+		slog.Error("save thread state", "error", err.Error())
+	}
+}
+
+// applyCommand applies the patches of thread as the owner of the repository.
+func (g *Gwi) applyCommand(repoDir, thread, branch string) {
+	namespace, repo := g.repoPath(repoDir)
+	user := owner(namespace)
+	committer := object.Signature{Name: user, When: time.Now()}
+	if u := g.vault.GetUser(user); u != nil {
+		committer.Email = u.Email()
+	}
+
+	head, err := g.ApplyThread(namespace, repo, thread, branch, committer)
+	if err != nil {
+		slog.Error("apply", "thread", thread, "error", err.Error())
+		return
+	}
+	slog.Info("thread applied", "thread", thread, "head", head.String())
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
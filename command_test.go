@@ -0,0 +1,101 @@
+package gwi
+
+import (
+	"net"
+	"net/smtp"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_Commands(t *testing.T) {
+	root := t.TempDir()
+	testRepo(t, root, "x", "proj")
+	repoDir := path.Join(root, "x", "proj")
+
+	g := Gwi{config: Config{Root: root, Domain: "localhost"}, vault: testVault()}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go g.serveMail(l)
+
+	msgs := []struct{ from, body string }{
+		{"y@localhost", "Found a bug.\r\n!close\r\n"},
+		{"x@localhost", "Thanks!\r\n> !reopen\r\n!label bug help\r\n"},
+		{"x@localhost", "!unlabel help\r\n!close\r\n"},
+	}
+	for i, m := range msgs {
+		msg := "From: <" + m.from + ">\r\nSubject: Crash\r\n\r\n" + m.body
+		if i > 0 {
+			msg = "From: <" + m.from + ">\r\nSubject: Re: Crash\r\n\r\n" + m.body
+		}
+		err := smtp.SendMail(l.Addr().String(), nil, m.from, []string{"x/proj@localhost"}, []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		state, _ := readThreadState(repoDir, "Crash")
+		if i == 0 && state.Closed {
+			t.Error("unauthorized sender closed the thread")
+		}
+		if i == 1 && (state.Closed || !reflect.DeepEqual(state.Labels, []string{"bug", "help"})) {
+			t.Errorf("unexpected state %+v", state)
+		}
+	}
+
+	// the From header is the owner's but the envelope sender is not
+	msg := "From: <x@localhost>\r\nSubject: Re: Crash\r\n\r\n!reopen\r\n"
+	if err := smtp.SendMail(l.Addr().String(), nil, "y@localhost", []string{"x/proj@localhost"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := readThreadState(repoDir, "Crash"); !state.Closed {
+		t.Error("forged envelope reopened the thread")
+	}
+
+	closed := g.threads(repoDir)("closed", "bug")
+	if len(closed) != 1 || !reflect.DeepEqual(closed[0].Labels, []string{"bug"}) {
+		t.Errorf("unexpected threads %+v", closed)
+	}
+	if open := g.threads(repoDir)("open"); len(open) != 0 {
+		t.Errorf("unexpected open threads %+v", open)
+	}
+}
+
+func Test_ApplyCommand(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	base := testCommit(t, repo, map[string]string{"README": "hello\nworld\n"}, "init")
+	repoDir := path.Join(root, "x", "proj")
+
+	patch := strings.Replace(testPatch1, "[PATCH 1/2]", "[PATCH]", 1)
+	if err := saveMail(repoDir, threadName("[PATCH] Add there"), []byte(patch)); err != nil {
+		t.Fatal(err)
+	}
+	send := func(relays ...string) {
+		g := Gwi{config: Config{Root: root, Domain: "localhost", MailTrustedRelays: relays}, vault: testVault()}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go g.serveMail(l)
+
+		msg := "From: <x@localhost>\r\nSubject: Re: [PATCH] Add there\r\nIn-Reply-To: <1@localhost>\r\n\r\n!apply main\r\n"
+		if err := smtp.SendMail(l.Addr().String(), nil, "x@localhost", []string{"x/proj@localhost"}, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send()
+	send("10.0.0.0/8", "192.168.0.1")
+	if head, _ := repo.Head(); head.Hash() != base {
+		t.Fatal("applied without a trusted relay")
+	}
+	send("127.0.0.0/8")
+	if head, _ := repo.Head(); head.Hash() == base {
+		t.Error("not applied from a trusted relay")
+	}
+}
@@ -0,0 +1,147 @@
+package gwi
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"log/slog"
+)
+
+// compressTypes are the content types compressed when the client accepts it,
+// packs are already compressed.
+var compressTypes = map[string]bool{
+	"text/html":        true,
+	"application/json": true,
+}
+
+// compress is a middleware that gzips the responses whose content type is
+// in compressTypes if the request accepts gzip.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip parses an Accept-Encoding header, a zero quality value
+// refuses the encoding.
+func acceptsGzip(header string) bool {
+	for _, enc := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		v, err := strconv.ParseFloat(q, 64)
+		return err == nil && v > 0
+	}
+	return false
+}
+
+// gzipWriter decides whether to compress when the header is written, by
+// looking at the content type set by the handler.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	typ, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if compressTypes[typ] && h.Get("Content-Encoding") == "" &&
+		code != http.StatusNoContent && code != http.StatusNotModified {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		// the compressed body is not byte for byte the one tagged
+		if tag := h.Get("ETag"); tag != "" && !strings.HasPrefix(tag, "W/") {
+			h.Set("ETag", "W/"+tag)
+		}
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+func (w *gzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// flushWriter flushes every write, so clients get streamed data as soon as
+// it is produced.
+type flushWriter struct {
+	w io.Writer
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return n, err
+}
+
+// decodeBody returns the body of the request decoded according to its
+// Content-Encoding, if the encoding is not supported it answers the request
+// and returns false.
+func decodeBody(w http.ResponseWriter, r *http.Request) (io.ReadCloser, bool) {
+	switch r.Header.Get("Content-Encoding") {
+	case "gzip", "x-gzip":
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			slog.Error("gzip body", "error", err.Error())
+			http.Error(w, "invalid gzip body", http.StatusBadRequest)
+			return nil, false
+		}
+		return body, true
+	case "identity", "":
+		return r.Body, true
+	}
+	w.Header().Set("Accept-Encoding", "identity, gzip")
+	http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+	return nil, false
+}
@@ -0,0 +1,92 @@
+package gwi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+func Test_Compress(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	head := testCommit(t, repo, map[string]string{"README.md": "# Hi\n"}, "init")
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, req)
+		return rec
+	}
+
+	plain := do(httptest.NewRequest(http.MethodGet, "/x/proj/tree", nil))
+	req := httptest.NewRequest(http.MethodGet, "/x/proj/tree", nil)
+	req.Header.Set("Accept-Encoding", "br;q=1, gzip;q=0.5")
+	rec := do(req)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("not compressed: %v", rec.Header())
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(gz)
+	if string(body) != plain.Body.String() {
+		t.Error("compressed body differs")
+	}
+	tag := rec.Header().Get("ETag")
+	if !strings.HasPrefix(tag, "W/") {
+		t.Errorf("etag of compressed body is strong: %s", tag)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/x/proj/tree", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", tag)
+	if rec := do(req); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("conditional compressed request: %d", rec.Code)
+	}
+
+	for _, accept := range []string{"", "gzip;q=0", "identity"} {
+		req := httptest.NewRequest(http.MethodGet, "/x/proj/tree", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		if rec := do(req); rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("compressed with Accept-Encoding %q", accept)
+		}
+	}
+
+	// gzipped upload-pack request, the pack is never compressed again
+	upr := packp.NewUploadPackRequest()
+	upr.Wants = append(upr.Wants, head)
+	buf := bytes.Buffer{}
+	zw := gzip.NewWriter(&buf)
+	if err := upr.UploadRequest.Encode(zw); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(zw, "0009done\n")
+	zw.Close()
+
+	req = httptest.NewRequest(http.MethodPost, "/x/proj/git-upload-pack", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = do(req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "" ||
+		!strings.HasPrefix(rec.Body.String(), "0008NAK\nPACK") {
+		t.Errorf("upload pack: %d %v %q", rec.Code, rec.Header(), rec.Body.String()[:min(rec.Body.Len(), 16)])
+	}
+	if !rec.Flushed {
+		t.Error("upload pack was not flushed")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/x/proj/git-upload-pack", strings.NewReader(""))
+	req.Header.Set("Content-Encoding", "br")
+	if rec := do(req); rec.Code != http.StatusUnsupportedMediaType || rec.Header().Get("Accept-Encoding") == "" {
+		t.Errorf("unsupported encoding: %d %v", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,176 @@
+package gwi
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/gorilla/mux"
+)
+
+// The handlers below implement the dumb HTTP protocol, used by clients that
+// don't speak smart HTTP. Only HEAD, the generated info files and objects
+// are served, so the configuration, hooks and gwi's files of repositories
+// are not exposed.
+
+// noCache marks responses that change with the references.
+func noCache(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
+
+// serveRepoFile sends the file name of the repository, objects never
+// change so they can be cached.
+func (g *Gwi) serveRepoFile(w http.ResponseWriter, r *http.Request, name, ctype string) {
+	vars := mux.Vars(r)
+	if !g.readable(w, r, vars["user"], vars["repo"]) {
+		return
+	}
+	repoDir := path.Join(g.config.Root, vars["user"], vars["repo"])
+
+	if strings.HasPrefix(name, "objects/") {
+		w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", cacheScope(isPrivate(repoDir)), int(immutableTTL.Seconds())))
+	} else {
+		noCache(w)
+	}
+	w.Header().Set("Content-Type", ctype)
+	http.ServeFile(w, r, path.Join(repoDir, name))
+}
+
+func (g *Gwi) headHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("git handling", "method", r.Method, "uri", r.RequestURI)
+
+	g.serveRepoFile(w, r, "HEAD", "text/plain")
+}
+
+func (g *Gwi) objHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("git handling object", "method", r.Method, "uri", r.RequestURI)
+
+	vars := mux.Vars(r)
+	name := path.Join("objects", vars["pre"], vars["obj"])
+	g.serveRepoFile(w, r, name, "application/x-git-loose-object")
+}
+
+func (g *Gwi) packHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("git handling pack", "method", r.Method, "uri", r.RequestURI)
+
+	pack := mux.Vars(r)["pack"]
+	ctype := "application/x-git-packed-objects"
+	if path.Ext(pack) == ".idx" {
+		ctype = "application/x-git-packed-objects-toc"
+	}
+	g.serveRepoFile(w, r, path.Join("objects", "pack", pack), ctype)
+}
+
+// dumbRefsHandler serves info/refs without a service, it is generated from
+// the references of the repository, as git update-server-info does.
+func (g *Gwi) dumbRefsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("git handling", "method", r.Method, "uri", r.RequestURI)
+
+	vars := mux.Vars(r)
+	if !g.readable(w, r, vars["user"], vars["repo"]) {
+		return
+	}
+	repo, err := repos.open(path.Join(g.config.Root, vars["user"], vars["repo"]))
+	if err != nil {
+		http.Error(w, ErrRepoNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	defer repo.close()
+	iter, err := repo.References()
+	if err != nil {
+		slog.Error("references", "error", err.Error())
+		http.Error(w, "error listing references", http.StatusInternalServerError)
+		return
+	}
+
+	var refs []*plumbing.Reference
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+
+	var out bytes.Buffer
+	for _, ref := range refs {
+		fmt.Fprintf(&out, "%s\t%s\n", ref.Hash(), ref.Name())
+		if peeled := peelTag(repo.Repository, ref.Hash()); peeled != ref.Hash() {
+			fmt.Fprintf(&out, "%s\t%s^{}\n", peeled, ref.Name())
+		}
+	}
+	noCache(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+// packsHandler generates objects/info/packs, listing the packfiles of the
+// repository.
+func (g *Gwi) packsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("git handling", "method", r.Method, "uri", r.RequestURI)
+
+	vars := mux.Vars(r)
+	if !g.readable(w, r, vars["user"], vars["repo"]) {
+		return
+	}
+	repoDir := path.Join(g.config.Root, vars["user"], vars["repo"])
+	if _, err := os.Stat(repoDir); err != nil {
+		http.Error(w, ErrRepoNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	var out bytes.Buffer
+	files, _ := os.ReadDir(path.Join(repoDir, "objects", "pack"))
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "pack-") && path.Ext(f.Name()) == ".pack" {
+			fmt.Fprintf(&out, "P %s\n", f.Name())
+		}
+	}
+	out.WriteString("\n")
+	noCache(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+// httpAlternatesHandler generates objects/info/http-alternates, so clients
+// find the objects forks share with their parents. The paths of the
+// alternates file are turned into paths of this server. Clients only use
+// them when http.followRedirects is true.
+func (g *Gwi) httpAlternatesHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("git handling", "method", r.Method, "uri", r.RequestURI)
+
+	vars := mux.Vars(r)
+	if !g.readable(w, r, vars["user"], vars["repo"]) {
+		return
+	}
+	root, err := filepath.Abs(g.config.Root)
+	if err != nil {
+		slog.Error("root path", "error", err.Error())
+		http.Error(w, "error reading alternates", http.StatusInternalServerError)
+		return
+	}
+
+	var out bytes.Buffer
+	for _, alt := range readAlternates(path.Join(g.config.Root, vars["user"], vars["repo"])) {
+		if rel, err := filepath.Rel(root, alt); err == nil && !strings.HasPrefix(rel, "..") {
+			fmt.Fprintf(&out, "/%s\n", filepath.ToSlash(rel))
+		}
+	}
+	if out.Len() == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	noCache(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out.Bytes())
+}
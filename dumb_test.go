@@ -0,0 +1,90 @@
+package gwi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func Test_DumbHTTP(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	first := testCommit(t, repo, map[string]string{"README.md": "one\n"}, "one")
+	_, err := repo.CreateTag("v1", first, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "tester", Email: "tester@localhost"},
+		Message: "v1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, path.Join(root, "x", "proj"), "repack", "-a", "-d")
+	head := testCommit(t, repo, map[string]string{"README.md": "two\n"}, "two")
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ForkRepo("x", "proj", "y"); err != nil {
+		t.Fatal(err)
+	}
+
+	// without the service parameter git falls back to the dumb protocol
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.RawQuery = ""
+		g.Handle().ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	work := t.TempDir()
+	for _, owner := range []string{"x", "y"} {
+		// git only follows alternates, used by the fork, if asked to
+		out := testGit(t, work, "-c", "http.followRedirects=true", "clone", srv.URL+"/"+owner+"/proj", owner)
+		if got := strings.TrimSpace(testGit(t, path.Join(work, owner), "rev-parse", "HEAD")); got != head.String() {
+			t.Errorf("dumb clone of %s: %s, want %s\n%s", owner, got, head, out)
+		}
+		testGit(t, path.Join(work, owner), "fsck")
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	refs := get("/x/proj/info/refs").Body.String()
+	if !strings.Contains(refs, head.String()+"\trefs/heads/main\n") || !strings.Contains(refs, "\trefs/tags/v1^{}\n") {
+		t.Errorf("info/refs:\n%s", refs)
+	}
+	if alt := get("/y/proj/objects/info/http-alternates").Body.String(); alt != "/x/proj/objects\n" {
+		t.Errorf("http-alternates: %q", alt)
+	}
+	for _, url := range []string{
+		"/x/proj/objects/config",
+		"/x/proj/objects/info/alternates",
+		"/y/proj/objects/info/alternates",
+		"/x/proj/objects/pack/../../config",
+		"/x/proj/objects/../hooks/pre-receive.sample",
+	} {
+		if rec := get(url); rec.Code == http.StatusOK {
+			t.Errorf("%s is served: %q", url, rec.Body.String())
+		}
+	}
+
+	if err := g.SetPrivate("x", "proj", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"/x/proj/info/refs", "/x/proj/HEAD", "/x/proj/objects/info/packs"} {
+		if rec := get(url); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s of private repo: %d", url, rec.Code)
+		}
+	}
+}
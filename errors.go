@@ -0,0 +1,115 @@
+package gwi
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/gorilla/mux"
+)
+
+// Errors of handlers, see [Gwi.httpError] for how they are shown.
+var (
+	ErrNotFound  = errors.New("page not found")
+	ErrForbidden = errors.New("forbidden")
+	ErrBadRef    = errors.New("ref not found")
+)
+
+// ErrorInfo is the data given to the 404.html and error.html templates.
+// Message is safe to show, internal errors only get the status text. User
+// and Repo are set if the request was for a repository.
+type ErrorInfo struct {
+	Status  int
+	Title   string
+	Message string
+	User    string
+	Repo    string
+	Path    string
+}
+
+// errorStatus returns the HTTP status code of err, errors not known are
+// internal.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrRepoNotFound),
+		errors.Is(err, ErrBadRef), errors.Is(err, git.ErrRepositoryNotExists),
+		errors.Is(err, plumbing.ErrReferenceNotFound),
+		errors.Is(err, plumbing.ErrObjectNotFound),
+		errors.Is(err, object.ErrFileNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalidName), errors.Is(err, ErrUnknownUser),
+		errors.Is(err, ErrNoPatches), errors.Is(err, ErrIncompleteSeries):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrRepoExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// errorMessage returns the text of err that can be shown to clients.
+func errorMessage(status int, err error) string {
+	if status == http.StatusInternalServerError {
+		return http.StatusText(status)
+	}
+	return err.Error()
+}
+
+// httpError answers a request with the status of err, rendering 404.html
+// for not found errors and error.html for the others, or plain text if the
+// template does not exist. Details of internal errors are only logged.
+func (g *Gwi) httpError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		slog.Error("request failed", "uri", r.RequestURI, "error", err.Error())
+	}
+	info := ErrorInfo{
+		Status:  status,
+		Title:   http.StatusText(status),
+		Message: errorMessage(status, err),
+		User:    mux.Vars(r)["user"],
+		Repo:    displayName(mux.Vars(r)["repo"]),
+		Path:    r.URL.Path,
+	}
+
+	pages, err := g.pages.get()
+	if err != nil {
+		slog.Error("templates", "error", err.Error())
+		http.Error(w, info.Message, status)
+		return
+	}
+	page := "error.html"
+	if status == http.StatusNotFound && pages.Lookup("404.html") != nil {
+		page = "404.html"
+	}
+	buf := bytes.Buffer{}
+	if pages.Lookup(page) == nil {
+		http.Error(w, info.Message, status)
+		return
+	}
+	if err := pages.ExecuteTemplate(&buf, page, info); err != nil {
+		slog.Error("execute", "page", page, "error", err.Error())
+		http.Error(w, info.Message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// repoError writes the status code that corresponds to an error returned by
+// the repository management functions.
+func repoError(w http.ResponseWriter, action string, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		slog.Error(action, "error", err.Error())
+	}
+	http.Error(w, errorMessage(status, err), status)
+}
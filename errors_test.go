@@ -0,0 +1,68 @@
+package gwi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_ErrorPages(t *testing.T) {
+	root := t.TempDir()
+	testCommit(t, testRepo(t, root, "x", "proj"), map[string]string{"README.md": "# Hi\n"}, "init")
+
+	pages := t.TempDir()
+	for name, content := range map[string]string{
+		"bad.html":   `{{template "secret"}}`,
+		"error.html": `{{.Status}} {{.Title}}: {{.Message}} {{.User}}/{{.Repo}}`,
+	} {
+		if err := os.WriteFile(path.Join(pages, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(g Gwi, url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: pages}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url  string
+		code int
+		body string
+	}{
+		{"/x/proj/-/nope", http.StatusNotFound, "404 Not Found: page not found x/proj"},
+		{"/x/proj/-/bad?ref=nope", http.StatusNotFound, "404 Not Found: ref not found x/proj"},
+		{"/x/proj/-/raw/nope.txt", http.StatusNotFound, "404 Not Found: file not found x/proj"},
+		{"/x/nope/-/bad", http.StatusNotFound, "404 Not Found: repository does not exist x/nope"},
+		{"/z/sub", http.StatusNotFound, "404 Not Found: page not found z/sub/"},
+		{"/x/proj/-/bad", http.StatusInternalServerError, "500 Internal Server Error: Internal Server Error x/proj"},
+	}
+	for _, tt := range tests {
+		rec := get(g, tt.url)
+		if rec.Code != tt.code || strings.TrimSpace(rec.Body.String()) != tt.body {
+			t.Errorf("%s: %d %q", tt.url, rec.Code, rec.Body)
+		}
+	}
+
+	// 404.html is used for not found errors, and text without templates
+	os.WriteFile(path.Join(pages, "404.html"), []byte(`missing {{.Path}}`), 0o600)
+	os.Remove(path.Join(pages, "error.html"))
+	if g, err = NewFromConfig(Config{Root: root, PagesRoot: pages}, testVault()); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(g, "/x/proj/-/nope"); rec.Code != http.StatusNotFound || rec.Body.String() != "missing /x/proj/-/nope" {
+		t.Errorf("404.html: %d %q", rec.Code, rec.Body)
+	}
+	rec := get(g, "/x/proj/-/bad")
+	if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("internal error: %d %q", rec.Code, rec.Body)
+	}
+}
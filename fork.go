@@ -0,0 +1,317 @@
+package gwi
+
+import (
+	"bufio"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/gorilla/mux"
+)
+
+// parentFile holds the user/repo name of the repository a fork came from.
+const parentFile = "parent"
+
+var alternatesFile = path.Join("objects", "info", "alternates")
+
+// forkIndex maps the repositories under each Root to their forks, it is
+// built on the first use and dropped when a repository is forked, moved or
+// deleted.
+var forkIndex = struct {
+	sync.Mutex
+	roots map[string]map[string][]string
+}{roots: map[string]map[string][]string{}}
+
+// ForkRepo creates a copy of owner's repo for user. The fork shares the
+// objects of its parent through git alternates, so only references are
+// copied, and the parent is recorded so it can be shown on templates. Forks
+// of private repositories are private too.
+func (g *Gwi) ForkRepo(owner, repo, user string) error {
+	src, err := g.repoDir(owner, repo)
+	if err != nil {
+		return err
+	}
+	dst, err := g.repoDir(user, repo)
+	if err == nil {
+		return ErrRepoExists
+	}
+	if err != ErrRepoNotFound {
+		return err
+	}
+	srcRepo, err := git.PlainOpen(src)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dst, os.ModeDir|0o700); err != nil {
+		return err
+	}
+	if err := copyRepo(srcRepo, src, dst); err != nil {
+		// a partial fork would block the next tries
+		os.RemoveAll(dst)
+		return err
+	}
+	defer g.invalidateForks()
+	return os.WriteFile(path.Join(dst, parentFile), []byte(owner+"/"+path.Base(src)), 0o600)
+}
+
+// copyRepo creates at dst a repository that borrows the objects of srcRepo,
+// at src, with the same references.
+func copyRepo(srcRepo *git.Repository, src, dst string) error {
+	fork, err := git.PlainInit(dst, true)
+	if err != nil {
+		return err
+	}
+	if isPrivate(src) {
+		if err := os.WriteFile(path.Join(dst, privateFile), nil, 0o600); err != nil {
+			return err
+		}
+	}
+
+	// objects of the parent come first, followed by the ones it borrows
+	objects, err := filepath.Abs(path.Join(src, "objects"))
+	if err != nil {
+		return err
+	}
+	alternates := append([]string{objects}, readAlternates(src)...)
+	if err := writeAlternates(dst, alternates); err != nil {
+		return err
+	}
+
+	refs, err := srcRepo.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		return fork.Storer.SetReference(ref)
+	})
+	if err != nil {
+		return err
+	}
+
+	if desc, err := os.ReadFile(path.Join(src, "description")); err == nil {
+		os.WriteFile(path.Join(dst, "description"), desc, 0o600)
+	}
+	return nil
+}
+
+func readAlternates(repoDir string) []string {
+	f, err := os.Open(path.Join(repoDir, alternatesFile))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var alternates []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			alternates = append(alternates, line)
+		}
+	}
+	return alternates
+}
+
+func writeAlternates(repoDir string, alternates []string) error {
+	file := path.Join(repoDir, alternatesFile)
+	if len(alternates) == 0 {
+		return os.Remove(file)
+	}
+	if err := os.MkdirAll(path.Dir(file), os.ModeDir|0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(file, []byte(strings.Join(alternates, "\n")+"\n"), 0o600)
+}
+
+func readParent(repoDir string) string {
+	parent, err := os.ReadFile(path.Join(repoDir, parentFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(parent))
+}
+
+// relinkForks updates the forks of a repository that moved from oldDir to
+// newDir. If newDir is empty the repository was deleted, so its objects are
+// copied into the forks before they stop borrowing them.
+func (g *Gwi) relinkForks(oldDir, newDir string) {
+	defer g.invalidateForks()
+	oldObjects, err := filepath.Abs(path.Join(oldDir, "objects"))
+	if err != nil {
+		slog.Error("abs", "error", err.Error())
+		return
+	}
+	newObjects := ""
+	if newDir != "" {
+		newObjects, err = filepath.Abs(path.Join(newDir, "objects"))
+		if err != nil {
+			slog.Error("abs", "error", err.Error())
+			return
+		}
+	}
+	oldUser, oldRepo := g.repoPath(oldDir)
+	newUser, newRepo := g.repoPath(newDir)
+	oldName, newName := oldUser+"/"+oldRepo, newUser+"/"+newRepo
+
+	eachRepo(g.config.Root, func(user, repo string) {
+		dir := path.Join(g.config.Root, user, repo)
+		alternates := readAlternates(dir)
+		changed := false
+		for i := 0; i < len(alternates); i++ {
+			if alternates[i] != oldObjects {
+				continue
+			}
+			changed = true
+			if newDir != "" {
+				alternates[i] = newObjects
+				continue
+			}
+
+			slog.Info("copying objects", "from", oldObjects, "to", dir)
+			if err := copyObjects(oldObjects, path.Join(dir, "objects")); err != nil {
+				slog.Error("copy objects", "error", err.Error())
+				return
+			}
+			alternates = append(alternates[:i], alternates[i+1:]...)
+			i--
+		}
+		if changed {
+			if err := writeAlternates(dir, alternates); err != nil {
+				slog.Error("write alternates", "error", err.Error())
+			}
+		}
+
+		if readParent(dir) != oldName {
+			return
+		}
+		if newDir == "" {
+			os.Remove(path.Join(dir, parentFile))
+			return
+		}
+		os.WriteFile(path.Join(dir, parentFile), []byte(newName), 0o600)
+	})
+}
+
+// copyObjects copies loose objects and packs from src to dst, skipping the
+// files dst already has.
+func copyObjects(src, dst string) error {
+	return filepath.WalkDir(src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == "info" {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(path.Join(dst, rel), os.ModeDir|0o700)
+		}
+		if _, err := os.Stat(path.Join(dst, rel)); err == nil {
+			return nil
+		}
+
+		in, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(path.Join(dst, rel), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o400)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// parent returns the user/repo the repository was forked from, or an empty
+// string if it is not a fork.
+func (g *Gwi) parent(repoDir string) func() string {
+	return func() string {
+		slog.Debug("getting parent", "repo", repoDir)
+		return displayName(readParent(repoDir))
+	}
+}
+
+// forks lists the forks of the repository as user/repo names. Private forks
+// are left out, so the list is the same for everyone.
+func (g *Gwi) forks(user, repo string) func() []string {
+	return func() []string {
+		slog.Debug("getting forks", "user", user, "repo", repo)
+		var forks []string
+		for _, name := range g.forkIndex()[user+"/"+repo] {
+			u, r := path.Split(name)
+			if !isPrivate(path.Join(g.config.Root, name)) {
+				forks = append(forks, u+displayName(r))
+			}
+		}
+		return forks
+	}
+}
+
+// forkIndex returns the forks of every repository under Root, keyed by the
+// user/repo name of their parent.
+func (g *Gwi) forkIndex() map[string][]string {
+	forkIndex.Lock()
+	defer forkIndex.Unlock()
+	if index, ok := forkIndex.roots[g.config.Root]; ok {
+		return index
+	}
+
+	slog.Debug("indexing forks", "root", g.config.Root)
+	index := map[string][]string{}
+	eachRepo(g.config.Root, func(u, r string) {
+		if parent := readParent(path.Join(g.config.Root, u, r)); parent != "" {
+			index[parent] = append(index[parent], u+"/"+r)
+		}
+	})
+	for _, forks := range index {
+		sort.Strings(forks)
+	}
+	forkIndex.roots[g.config.Root] = index
+	return index
+}
+
+func (g *Gwi) invalidateForks() {
+	forkIndex.Lock()
+	defer forkIndex.Unlock()
+	delete(forkIndex.roots, g.config.Root)
+}
+
+// forkHandler forks the repository into the namespace of the authenticated
+// user.
+func (g *Gwi) forkHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	slog.Debug("running fork handler", "vars", vars)
+
+	login, ok := g.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if !g.canRead(r, vars["user"], vars["repo"]) {
+		http.Error(w, ErrRepoNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := g.ForkRepo(vars["user"], vars["repo"], login); err != nil {
+		repoError(w, "fork", err)
+		return
+	}
+	http.Redirect(w, r, "/"+login+"/"+vars["repo"], http.StatusSeeOther)
+}
@@ -0,0 +1,116 @@
+package gwi
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func Test_Fork(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	hash := testCommit(t, repo, map[string]string{"README.md": "hi"}, "init")
+
+	g := Gwi{config: Config{Root: root}}
+	if err := g.ForkRepo("x", "proj", "y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ForkRepo("x", "proj", "y"); err != ErrRepoExists {
+		t.Errorf("second fork returned %v", err)
+	}
+
+	forkDir := path.Join(root, "y", "proj")
+	check := func(parent string) {
+		t.Helper()
+		fork, err := git.PlainOpen(forkDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head, err := fork.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.Hash() != hash {
+			t.Errorf("fork head is %s, want %s", head.Hash(), hash)
+		}
+		if _, err := fork.CommitObject(hash); err != nil {
+			t.Error(err)
+		}
+		if p := g.parent(forkDir)(); p != parent {
+			t.Errorf("parent is %q, want %q", p, parent)
+		}
+	}
+
+	check("x/proj")
+	if forks := g.forks("x", "proj")(); !reflect.DeepEqual(forks, []string{"y/proj"}) {
+		t.Errorf("forks are %v", forks)
+	}
+
+	// private forks are not listed
+	if err := g.ForkRepo("x", "proj", "z"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetPrivate("z", "proj", true); err != nil {
+		t.Fatal(err)
+	}
+	if forks := g.forks("x", "proj")(); !reflect.DeepEqual(forks, []string{"y/proj"}) {
+		t.Errorf("forks with a private one are %v", forks)
+	}
+	if err := g.SetPrivate("z", "proj", false); err != nil {
+		t.Fatal(err)
+	}
+	if forks := g.forks("x", "proj")(); !reflect.DeepEqual(forks, []string{"y/proj", "z/proj"}) {
+		t.Errorf("forks are %v", forks)
+	}
+
+	if err := g.RenameRepo("x", "proj", "app"); err != nil {
+		t.Fatal(err)
+	}
+	check("x/app")
+	if forks := g.forks("x", "proj")(); len(forks) != 0 {
+		t.Errorf("forks of the old name are %v", forks)
+	}
+	if forks := g.forks("x", "app")(); !reflect.DeepEqual(forks, []string{"y/proj", "z/proj"}) {
+		t.Errorf("forks after rename are %v", forks)
+	}
+
+	if err := g.DeleteRepo("x", "app"); err != nil {
+		t.Fatal(err)
+	}
+	check("")
+	if alt := readAlternates(forkDir); len(alt) != 0 {
+		t.Errorf("fork still has alternates %v", alt)
+	}
+}
+
+func Test_ForkFails(t *testing.T) {
+	root := t.TempDir()
+	testCommit(t, testRepo(t, root, "x", "secret"), map[string]string{"README.md": "hi"}, "init")
+	g := Gwi{config: Config{Root: root}}
+	if err := g.SetPrivate("x", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed fork leaves nothing behind
+	packed := path.Join(root, "x", "secret", "packed-refs")
+	if err := os.WriteFile(packed, []byte("not a ref line\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ForkRepo("x", "secret", "x/team"); err == nil {
+		t.Fatal("fork with broken references succeeded")
+	}
+	if _, err := os.Stat(path.Join(root, "x", "team", "secret")); !os.IsNotExist(err) {
+		t.Errorf("failed fork left its folder: %v", err)
+	}
+
+	os.Remove(packed)
+	if err := g.ForkRepo("x", "secret", "x/team"); err != nil {
+		t.Fatal(err)
+	}
+	if !isPrivate(path.Join(root, "x", "team", "secret")) {
+		t.Error("fork of private repository is public")
+	}
+}
@@ -2,6 +2,9 @@ package gwi
 
 import (
 	"html/template"
+	"os"
+	"path"
+	"strings"
 	"syscall"
 
 	"log/slog"
@@ -133,3 +136,65 @@ func (g *Gwi) tags(repo *git.Repository) func() []*plumbing.Reference {
 		return tags
 	}
 }
+
+// head returns the reference HEAD points to, nil for empty repositories.
+func (g *Gwi) head(repo *git.Repository) func() *plumbing.Reference {
+	return func() *plumbing.Reference {
+		slog.Debug("getting head")
+		head, err := repo.Head()
+		if err != nil {
+			slog.Debug("head", "error", err.Error())
+			return nil
+		}
+		return head
+	}
+}
+
+func (g *Gwi) commit(repo *git.Repository) func(ref plumbing.Hash) *object.Commit {
+	return func(ref plumbing.Hash) *object.Commit {
+		slog.Debug("getting commit", "ref", ref.String())
+		commit, err := repo.CommitObject(ref)
+		if err != nil {
+			slog.Error("commit", "error", err.Error())
+			return nil
+		}
+		return commit
+	}
+}
+
+// users lists the folders of Root, which are the users.
+func (g *Gwi) users() []string {
+	slog.Debug("getting users")
+	dir, err := os.ReadDir(g.config.Root)
+	if err != nil {
+		slog.Error("readDir", "error", err.Error())
+		return nil
+	}
+
+	var users []string
+	for _, d := range dir {
+		if d.IsDir() && !strings.HasPrefix(d.Name(), ".") {
+			users = append(users, d.Name())
+		}
+	}
+	return users
+}
+
+// repos lists the public repositories of user, including the ones in groups,
+// as paths relative to the user.
+func (g *Gwi) repos(user string) []string {
+	slog.Debug("getting repos", "user", user)
+	if !validNamespace(user) {
+		return nil
+	}
+
+	var repos []string
+	eachGroupRepo(g.config.Root, user, func(group, repo string) {
+		if isPrivate(path.Join(g.config.Root, group, repo)) {
+			return
+		}
+		groups := strings.TrimPrefix(strings.TrimPrefix(group, user), "/")
+		repos = append(repos, path.Join(groups, displayName(repo)))
+	})
+	return repos
+}
@@ -1,18 +1,13 @@
 package gwi
 
 import (
-	"bytes"
-	"compress/gzip"
-	"io"
 	"net/http"
-	"os"
 	"path"
 
 	"log/slog"
 
 	"github.com/go-git/go-billy/v5/osfs"
 
-	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/format/pktline"
 	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
@@ -23,6 +18,14 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// init lets go-git advertise multi_ack, only thin-pack stays hidden. The
+// list is global and read by every session, so it is set once.
+func init() {
+	transport.UnsupportedCapabilities = []capability.Capability{
+		capability.ThinPack,
+	}
+}
+
 // GitHandler is the interface with git that handles git operations
 // like pull and push. To use this handler use the correct config options.
 func (g *Gwi) infoRefsHandler(w http.ResponseWriter, r *http.Request) {
@@ -37,55 +40,31 @@ func (g *Gwi) infoRefsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid URL", http.StatusBadRequest)
 		return
 	}
-	transport.UnsupportedCapabilities = []capability.Capability{
-		capability.ThinPack,
-	}
-
 	gitServer := server.NewServer(server.NewFilesystemLoader(osfs.New(g.config.Root)))
 	var sess transport.Session
 	switch service {
 	case "git-receive-pack":
-		// needs auth
-		login, pass, ok := r.BasicAuth()
-		if !ok || login == "" || pass == "" {
-			w.Header().Set("WWW-Authenticate", "Basic")
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		if user != login {
-			http.Error(w, "invalid repo", http.StatusUnauthorized)
+		if !g.authorize(w, r, user) {
 			return
 		}
-		slog.Info("successful authentication")
 
 		// create repo if it doesn't exists
-		repoDir := path.Join(g.config.Root, user, repo)
-		if _, err := os.Stat(repoDir); err != nil {
-			slog.Info("repo stat", "error", err.Error())
-
-			os.Mkdir(repoDir, os.ModeDir|0o700)
-			r, err := git.PlainInit(repoDir, true)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			h := plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.ReferenceName("refs/heads/main"))
-			if err := r.Storer.SetReference(h); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			cfg, err := r.Config()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			cfg.Init.DefaultBranch = "main"
-			r.Storer.SetConfig(cfg)
+		err := g.CreateRepo(user, repo, "main")
+		if err != nil && err != ErrRepoExists {
+			slog.Error("create repo", "error", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		sess, err = gitServer.NewReceivePackSession(end, nil)
 	case "git-upload-pack":
+		if !g.readable(w, r, user, repo) {
+			return
+		}
 		sess, err = gitServer.NewUploadPackSession(end, nil)
+	default:
+		http.Error(w, "unsupported service", http.StatusForbidden)
+		return
 	}
 	if err != nil {
 		slog.Error("session", "error", err.Error())
@@ -93,24 +72,10 @@ func (g *Gwi) infoRefsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Header.Get("Git-Protocol") == "version=2" {
-		caps, err := sess.AdvertisedCapabilities()
-		if err != nil {
-			slog.Error("caps", "error", err.Error())
-			http.Error(w, "caps error: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		caps.Capabilities.Add(capability.Agent, "git/gwi")
-		caps.Capabilities.Add(capability.Fetch, capability.Shallow.String(), capability.Filter.String(), capability.WaitForDone.String())
-		caps.Capabilities.Add(capability.LsRefs, "unborn")
-		caps.Capabilities.Add(capability.ObjectFormat, "sha1")
-		caps.Capabilities.Add(capability.ServerOption)
-
-		caps.Service = service
-		w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
-		if err := caps.Encode(w); err != nil {
-			slog.Error("encode caps", "error", err.Error())
-			http.Error(w, "encode caps error", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
+	if service == "git-upload-pack" && protocolVersion(r) == 2 {
+		if err := advertiseV2(w); err != nil {
+			slog.Error("advertise v2", "error", err.Error())
 		}
 		return
 	}
@@ -125,9 +90,23 @@ func (g *Gwi) infoRefsHandler(w http.ResponseWriter, r *http.Request) {
 		[]byte("# service=" + service),
 		pktline.Flush,
 	}
-	refs.Capabilities.Add(capability.NoDone)
+	refs.Capabilities.Add(capability.Sideband64k)
+	if service == "git-upload-pack" {
+		for _, c := range []capability.Capability{
+			capability.NoProgress,
+			capability.IncludeTag,
+			capability.Shallow,
+			capability.DeepenRelative,
+			capability.DeepenSince,
+			capability.DeepenNot,
+			capability.Filter,
+			capability.AllowTipSHA1InWant,
+			capability.AllowReachableSHA1InWant,
+		} {
+			refs.Capabilities.Add(c)
+		}
+	}
 
-	w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
 	w.Header().Set("Accept-Encoding", "identity")
 	if err := refs.Encode(w); err != nil {
 		slog.Error("encode refs", "error", err.Error())
@@ -140,20 +119,9 @@ func (g *Gwi) infoRefsHandler(w http.ResponseWriter, r *http.Request) {
 func (g *Gwi) receivePackHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("git handling", "method", r.Method, "uri", r.RequestURI)
 
-	login, pass, ok := r.BasicAuth()
 	user := mux.Vars(r)["user"]
 	repo := mux.Vars(r)["repo"]
-	if !ok || login == "" || pass == "" {
-		w.Header().Set("WWW-Authenticate", "Basic")
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-	if !g.vault.Validate(login, pass) {
-		http.Error(w, "invalid login", http.StatusUnauthorized)
-		return
-	}
-	if user != login {
-		http.Error(w, "invalid repo", http.StatusUnauthorized)
+	if !g.authorize(w, r, user) {
 		return
 	}
 
@@ -173,23 +141,11 @@ func (g *Gwi) receivePackHandler(w http.ResponseWriter, r *http.Request) {
 
 	upr := packp.NewReferenceUpdateRequest()
 
-	var body io.Reader
-	switch r.Header.Get("Content-Encoding") {
-	case "gzip":
-		body, err = gzip.NewReader(r.Body)
-		if err != nil {
-			w.Header().Add("Accept-encoding", "identity")
-			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
-			return
-		}
-	case "identity", "":
-		body = r.Body
-	default:
-		w.Header().Add("Accept-encoding", "identity,gzip")
-		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	body, ok := decodeBody(w, r)
+	if !ok {
 		return
 	}
-	w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+	defer body.Close()
 
 	if err := upr.Decode(body); err != nil {
 		slog.Error("reference decode", "error", err.Error())
@@ -198,153 +154,112 @@ func (g *Gwi) receivePackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	slog.Debug("request:", "commands", upr.Commands, "caps", *upr.Capabilities)
 
+	band := useSideband(upr.Capabilities)
 	res, err := sess.ReceivePack(r.Context(), upr)
 	if err != nil {
+		// the report tells which commands failed
 		slog.Error("receive pack", "error", err.Error())
+	}
+	if res == nil && !band {
 		http.Error(w, "receive pack: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
-	if err := res.Encode(w); err != nil {
-		slog.Error("encode response", "error", err.Error())
-		http.Error(w, "encode response", http.StatusInternalServerError)
+	if !band {
+		if err := res.Encode(w); err != nil {
+			slog.Error("encode response", "error", err.Error())
+		}
+		slog.Debug("sent", "response", *res, "status", res.CommandStatuses)
+		g.postReceive(user, repo, upr.Commands, res)
+		return
 	}
-	slog.Debug("sent", "response", *res, "status", res.CommandStatuses)
-}
-
-func (g *Gwi) uploadPackHandler(w http.ResponseWriter, r *http.Request) {
-	slog.Debug("git handling", "method", r.Method, "uri", r.RequestURI)
-
-	user := mux.Vars(r)["user"]
-	repo := mux.Vars(r)["repo"]
 
-	gitServer := server.NewServer(server.NewFilesystemLoader(osfs.New(g.config.Root)))
-	end, err := transport.NewEndpoint(user + "/" + repo)
-	if err != nil {
-		slog.Error("invalid URL", "error", err.Error())
-		http.Error(w, "invalid URL", http.StatusBadRequest)
+	b := newBandWriter(flushWriter{w})
+	if res == nil {
+		b.fatal(err)
+		b.flush()
 		return
 	}
-	sess, err := gitServer.NewUploadPackSession(end, nil)
-	if err != nil {
-		slog.Error("session", "error", err.Error())
-		http.Error(w, "session", http.StatusInternalServerError)
-		return
+	if res.UnpackStatus != "ok" {
+		b.progress("error: unpacking failed: %s\n", res.UnpackStatus)
 	}
-
-	var body io.Reader
-	switch r.Header.Get("Content-Encoding") {
-	case "gzip":
-		body, err = gzip.NewReader(r.Body)
-		if err != nil {
-			w.Header().Add("Accept-encoding", "identity")
-			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
-			return
+	for _, s := range res.CommandStatuses {
+		if s.Error() != nil {
+			b.progress("error: %s not updated: %s\n", s.ReferenceName, s.Status)
 		}
-	case "identity", "":
-		body = r.Body
-	default:
-		w.Header().Add("Accept-encoding", "identity,gzip")
-		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
-		return
 	}
+	if err := res.Encode(b); err != nil {
+		slog.Error("encode response", "error", err.Error())
+	}
+	b.flush()
+	slog.Debug("sent", "response", *res, "status", res.CommandStatuses)
 
-	if r.Header.Get("Git-Protocol") == "version=2" {
-		comm := packp.NewCommandRequest()
-		if err := comm.Decode(body); err != nil {
-			slog.Error("command decode", "error", err.Error())
-			http.Error(w, "command decode: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-		slog.Debug("v2 request", "command", comm.Command, "caps", comm.Capabilities, "args", comm.Args)
+	g.postReceive(user, repo, upr.Commands, res)
+}
 
-		res, err := sess.CommandHandler(r.Context(), comm)
-		if err != nil {
-			slog.Error("command", "error", err.Error())
-			http.Error(w, "command: "+err.Error(), http.StatusBadRequest)
-			return
-		}
+// postReceive runs the actions that follow a successful push, only the
+// commands that were accepted are considered.
+func (g *Gwi) postReceive(user, repo string, cmds []*packp.Command, res *packp.ReportStatus) {
+	if res.UnpackStatus != "ok" {
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
-		err = res.Encode(w)
-		if err != nil {
-			slog.Error("command", "error", err.Error())
+	failed := map[plumbing.ReferenceName]bool{}
+	for _, s := range res.CommandStatuses {
+		if s.Error() != nil {
+			failed[s.ReferenceName] = true
 		}
-		return
 	}
 
-	upr := packp.NewUploadPackRequest()
-	if err := upr.Decode(body); err != nil {
-		slog.Error("upload decode", "error", err.Error())
-		http.Error(w, "upload decode: "+err.Error(), http.StatusBadRequest)
-		return
+	var updated []*packp.Command
+	for _, c := range cmds {
+		if !failed[c.Name] {
+			updated = append(updated, c)
+		}
 	}
-	slog.Debug("request", "wants", upr.Wants, "haves", upr.Haves, "caps", *upr.Capabilities)
+	g.refsUpdated(user, repo, updated)
+}
 
-	res, err := sess.UploadPack(r.Context(), upr)
-	if err != nil {
-		slog.Error("upload pack", "error", err.Error())
-		http.Error(w, "upload pack: "+err.Error(), http.StatusInternalServerError)
+// refsUpdated runs the actions that follow changes to the references of a
+// repository, by a push or by gwi itself.
+func (g *Gwi) refsUpdated(user, repo string, cmds []*packp.Command) {
+	if len(cmds) == 0 {
 		return
 	}
-	slog.Debug("response", "acks", res.ACKs, "serverAcks", res.ServerResponse.ACKs)
 
-	buff := bytes.Buffer{}
-	if err := res.Encode(&buff); err != nil {
-		slog.Error("encode response", "error", err.Error())
-		http.Error(w, "encode response", http.StatusInternalServerError)
+	repos.invalidate(path.Join(g.config.Root, user, repo))
+	g.sendWebhooks(user, repo, cmds)
+	go g.pushMirrors(user, repo)
+	go g.notifyPush(user, repo, cmds)
+	if g.config.SearchIndex {
+		go func() {
+			if err := g.updateIndex(user, repo); err != nil {
+				slog.Error("update index", "error", err.Error())
+			}
+		}()
 	}
-
-	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
-	w.Write(buff.Bytes())
-
-	slog.Debug("sent", "response", res.ServerResponse, "acks", res.ACKs)
-}
-
-func (g *Gwi) headHandler(w http.ResponseWriter, r *http.Request) {
-	slog.Debug("git handling", "method", r.Method, "uri", r.RequestURI)
-
-	vars := mux.Vars(r)
-	repoDir := path.Join(g.config.Root, vars["user"], vars["repo"])
-
-	w.Header().Set("Content-Type", "text/plain")
-
-	http.ServeFile(w, r, path.Join(repoDir, "HEAD"))
 }
 
-func (g *Gwi) fileHandler(w http.ResponseWriter, r *http.Request) {
+func (g *Gwi) uploadPackHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("git handling", "method", r.Method, "uri", r.RequestURI)
 
-	vars := mux.Vars(r)
-	repoDir := path.Join(g.config.Root, vars["user"], vars["repo"])
-
-	switch path.Ext(r.URL.Path) {
-	case ".idx":
-		w.Header().Set(
-			"Content-Type",
-			"application/x-git-packed-objects-toc",
-		)
-	case ".pack":
-		w.Header().Set(
-			"Content-Type",
-			"application/x-git-packed-objects",
-		)
-	default:
-		w.Header().Set("Content-Type", "text/plain")
+	user := mux.Vars(r)["user"]
+	repo := mux.Vars(r)["repo"]
+	if !g.readable(w, r, user, repo) {
+		return
 	}
 
-	http.ServeFile(w, r, path.Join(repoDir, vars["obj"]))
-}
-
-func (g *Gwi) objHandler(w http.ResponseWriter, r *http.Request) {
-	slog.Debug("git handling object", "method", r.Method, "uri", r.RequestURI)
-
-	vars := mux.Vars(r)
-	repoDir := path.Join(g.config.Root, vars["user"], vars["repo"])
-	obj := vars["pre"] + "/" + vars["obj"]
-
-	w.Header().Set("Content-Type", "application/x-git-loose-objects")
+	body, ok := decodeBody(w, r)
+	if !ok {
+		return
+	}
+	defer body.Close()
 
-	http.ServeFile(w, r, path.Join(repoDir, "objects", obj))
+	repoDir := path.Join(g.config.Root, user, repo)
+	if protocolVersion(r) == 2 {
+		serveV2(w, body, repoDir)
+		return
+	}
+	uploadPack(w, body, repoDir)
 }
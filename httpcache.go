@@ -0,0 +1,139 @@
+package gwi
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Pages addressed by a full commit hash never change, so they are cached for
+// a year, others are cached for refTTL as branches move.
+const (
+	immutableTTL = 365 * 24 * time.Hour
+	refTTL       = time.Minute
+)
+
+// resolveRef finds the commit a ref given on a URL points to, it can be a
+// commit hash, a branch or tag name, or empty for HEAD. Immutable tells
+// whether ref is a full hash, whose content never changes.
+func resolveRef(repo *git.Repository, ref string) (commit *object.Commit, immutable bool, err error) {
+	if ref == "" || ref == plumbing.ZeroHash.String() {
+		head, err := repo.Head()
+		if err != nil {
+			return nil, false, err
+		}
+		commit, err := repo.CommitObject(head.Hash())
+		return commit, false, err
+	}
+
+	if isHash(ref) {
+		h := plumbing.NewHash(ref)
+		if tag, err := repo.TagObject(h); err == nil {
+			commit, err := tag.Commit()
+			return commit, true, err
+		}
+		if commit, err := repo.CommitObject(h); err == nil {
+			return commit, true, nil
+		}
+	}
+
+	for _, name := range []plumbing.ReferenceName{
+		plumbing.NewBranchReferenceName(ref),
+		plumbing.NewTagReferenceName(ref),
+	} {
+		r, err := repo.Reference(name, true)
+		if err != nil {
+			continue
+		}
+		if tag, err := repo.TagObject(r.Hash()); err == nil {
+			commit, err := tag.Commit()
+			return commit, false, err
+		}
+		commit, err := repo.CommitObject(r.Hash())
+		return commit, false, err
+	}
+
+	// short hashes and other revisions
+	h, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return nil, false, plumbing.ErrReferenceNotFound
+	}
+	commit, err = repo.CommitObject(*h)
+	return commit, false, err
+}
+
+func isHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// etag builds a strong entity tag from the given parts.
+func etag(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "\x00")))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// cacheScope returns the Cache-Control scope of responses of a repository,
+// private ones must not be stored by shared caches.
+func cacheScope(private bool) string {
+	if private {
+		return "private"
+	}
+	return "public"
+}
+
+// cacheHeaders sets the caching headers of a response, responses of private
+// repositories are only cached by the client. If the request already has the
+// content it answers with 304 Not Modified and returns true. A zero modified
+// time omits Last-Modified.
+func cacheHeaders(w http.ResponseWriter, r *http.Request, tag string, modified time.Time, immutable, private bool) bool {
+	h := w.Header()
+	if immutable {
+		h.Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", cacheScope(private), int(immutableTTL.Seconds())))
+	} else {
+		h.Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", cacheScope(private), int(refTTL.Seconds())))
+	}
+	if tag != "" {
+		h.Set("ETag", tag)
+	}
+	if !modified.IsZero() {
+		h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if tag == "" || !etagMatch(inm, tag) {
+			return false
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil ||
+		modified.IsZero() || modified.Truncate(time.Second).After(ims) {
+		return false
+	}
+
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+func etagMatch(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
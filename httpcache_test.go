@@ -0,0 +1,121 @@
+package gwi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func Test_HTTPCache(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	first := testCommit(t, repo, map[string]string{"README.md": "# Hi\n", "page.html": "<script>x</script>\n"}, "init")
+	second := testCommit(t, repo, map[string]string{"README.md": "# Hello\n", "page.html": "<script>x</script>\n"}, "update")
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/tags/v1", first)); err != nil {
+		t.Fatal(err)
+	}
+
+	refs := map[string]plumbing.Hash{
+		"":                 second,
+		"main":             second,
+		"v1":               first,
+		first.String():     first,
+		first.String()[:7]: first,
+	}
+	for ref, want := range refs {
+		commit, immutable, err := resolveRef(repo, ref)
+		if err != nil || commit.Hash != want || immutable != (ref == first.String()) {
+			t.Errorf("resolve %q: %v %v %v", ref, commit, immutable, err)
+		}
+	}
+	if _, _, err := resolveRef(repo, "nope"); err == nil {
+		t.Error("unknown ref resolved")
+	}
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(url string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, url := range []string{
+		"/x/proj/tree?ref=" + first.String(),
+		"/x/proj/zip?ref=" + first.String(),
+		"/x/proj/raw/README.md?ref=" + first.String(),
+	} {
+		rec := get(url)
+		tag := rec.Header().Get("ETag")
+		if rec.Code != http.StatusOK || tag == "" || rec.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+			t.Errorf("%s: %d %v", url, rec.Code, rec.Header())
+		}
+		if rec := get(url, "If-None-Match", tag); rec.Code != http.StatusNotModified {
+			t.Errorf("%s with etag: %d", url, rec.Code)
+		}
+		since := time.Now().UTC().Format(http.TimeFormat)
+		if rec := get(url, "If-Modified-Since", since); rec.Code != http.StatusNotModified {
+			t.Errorf("%s with date: %d", url, rec.Code)
+		}
+	}
+
+	rec := get("/x/proj/tree?ref=main")
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("branch page: %d %v", rec.Code, rec.Header())
+	}
+	if rec := get("/x/proj/tree?ref=main", "If-None-Match", rec.Header().Get("ETag")); rec.Code != http.StatusNotModified {
+		t.Errorf("branch page with etag: %d", rec.Code)
+	}
+	if rec := get("/x/proj/tree?ref=nope"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown ref: %d", rec.Code)
+	}
+
+	rec = get("/x/proj/raw/README.md?ref=v1")
+	if rec.Body.String() != "# Hi\n" || rec.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("raw by tag: %q %v", rec.Body.String(), rec.Header())
+	}
+	rec = get("/x/proj/raw/page.html")
+	if rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("raw html served as %s", rec.Header().Get("Content-Type"))
+	}
+	if rec := get("/x/proj/raw/none"); rec.Code != http.StatusNotFound {
+		t.Errorf("raw missing file: %d", rec.Code)
+	}
+
+	// pages showing branches, tags or threads change even at a fixed hash
+	for _, op := range []string{"summary", "branches", "tags", "lists"} {
+		url := "/x/proj/-/" + op + "?ref=" + first.String()
+		rec := get(url)
+		if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "public, max-age=60" {
+			t.Errorf("%s: %d %v", url, rec.Code, rec.Header())
+		}
+		if rec := get(url, "If-None-Match", rec.Header().Get("ETag")); rec.Code != http.StatusNotModified {
+			t.Errorf("%s with etag: %d", url, rec.Code)
+		}
+	}
+
+	// shared caches must not keep pages of private repositories
+	if err := g.SetPrivate("x", "proj", true); err != nil {
+		t.Fatal(err)
+	}
+	for url, want := range map[string]string{
+		"/x/proj/-/tree?ref=" + first.String():    "private, max-age=31536000, immutable",
+		"/x/proj/-/zip?ref=" + first.String():     "private, max-age=31536000, immutable",
+		"/x/proj/-/raw/README.md?ref=main":        "private, max-age=60",
+		"/x/proj/-/summary?ref=" + first.String(): "private, max-age=60",
+	} {
+		rec := get(url, "Authorization", "Basic eDoxMjM0")
+		if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != want {
+			t.Errorf("private %s: %d %v", url, rec.Code, rec.Header())
+		}
+	}
+}
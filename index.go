@@ -0,0 +1,396 @@
+package gwi
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// indexFile holds the search index of the default branch of a repository,
+// it is kept inside the bare repository.
+const indexFile = "search.idx"
+
+var (
+	// indexes caches the loaded indexes by repository folder, they are not
+	// changed after being built so they can be read without locks.
+	indexes  = map[string]*repoIndex{}
+	indexMu  sync.Mutex
+	updateMu sync.Mutex
+)
+
+type trigram uint32
+
+// repoIndex maps the trigrams of the files of a commit to the files that
+// contain them. Text is lowercased so searches can ignore case, binary and
+// big files have no trigrams.
+type repoIndex struct {
+	Commit plumbing.Hash
+	Files  map[string]indexedFile
+
+	postings map[trigram][]string
+}
+
+type indexedFile struct {
+	Blob     plumbing.Hash
+	Text     bool
+	Trigrams []trigram
+}
+
+// RepoSearchResult holds the matches found on a repository by the global
+// search.
+type RepoSearchResult struct {
+	User string
+	Repo string
+	SearchResult
+}
+
+func trigrams(data []byte) []trigram {
+	data = bytes.ToLower(data)
+	set := map[trigram]bool{}
+	for i := 0; i+3 <= len(data); i++ {
+		set[trigram(data[i])<<16|trigram(data[i+1])<<8|trigram(data[i+2])] = true
+	}
+
+	list := make([]trigram, 0, len(set))
+	for t := range set {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+func (idx *repoIndex) build() {
+	idx.postings = map[trigram][]string{}
+	for name, f := range idx.Files {
+		for _, t := range f.Trigrams {
+			idx.postings[t] = append(idx.postings[t], name)
+		}
+	}
+}
+
+// loadIndex returns the index of the repository, nil if it was not built.
+func loadIndex(repoDir string) *repoIndex {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if idx, ok := indexes[repoDir]; ok {
+		return idx
+	}
+
+	file, err := os.Open(path.Join(repoDir, indexFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("open index", "error", err.Error())
+		}
+		return nil
+	}
+	defer file.Close()
+
+	idx := &repoIndex{}
+	if err := gob.NewDecoder(file).Decode(idx); err != nil {
+		slog.Error("decode index", "repo", repoDir, "error", err.Error())
+		return nil
+	}
+	idx.build()
+	indexes[repoDir] = idx
+	return idx
+}
+
+// dropIndex forgets the loaded index of the repository, it must be called
+// when the repository is moved or deleted.
+func dropIndex(repoDir string) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	delete(indexes, repoDir)
+}
+
+func saveIndex(repoDir string, idx *repoIndex) error {
+	tmp := path.Join(repoDir, "."+indexFile)
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(file).Encode(idx); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(repoDir, indexFile))
+}
+
+// updateIndex brings the index of the repository up to date with its
+// default branch, only files that changed since the last update are read.
+func (g *Gwi) updateIndex(user, repo string) error {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	repoDir := path.Join(g.config.Root, user, repo)
+	r, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return err
+	}
+	head, err := r.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		// empty repository
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	old := loadIndex(repoDir)
+	if old != nil && old.Commit == head.Hash() {
+		return nil
+	}
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	idx := &repoIndex{Commit: head.Hash(), Files: map[string]indexedFile{}}
+	read := 0
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if old != nil {
+			if prev, ok := old.Files[f.Name]; ok && prev.Blob == f.Hash {
+				idx.Files[f.Name] = prev
+				return nil
+			}
+		}
+
+		entry := indexedFile{Blob: f.Hash}
+		if f.Mode.IsFile() && f.Size <= searchMaxFileSize {
+			r, err := f.Reader()
+			if err != nil {
+				return err
+			}
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			if !isBinary(data) {
+				entry.Text = true
+				entry.Trigrams = trigrams(data)
+			}
+		}
+		idx.Files[f.Name] = entry
+		read++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	idx.build()
+
+	if err := saveIndex(repoDir, idx); err != nil {
+		return err
+	}
+	indexMu.Lock()
+	indexes[repoDir] = idx
+	indexMu.Unlock()
+	slog.Info("index updated", "repo", repoDir, "commit", idx.Commit.String(), "read", read)
+	return nil
+}
+
+// indexRepos updates the index of every repository.
+func (g *Gwi) indexRepos() {
+	eachRepo(g.config.Root, func(user, repo string) {
+		if err := g.updateIndex(user, repo); err != nil {
+			slog.Error("update index", "repo", user+"/"+repo, "error", err.Error())
+		}
+	})
+}
+
+// queryLiterals returns strings that every match of the search must contain,
+// for regexes only literals concatenated at the top level are considered.
+func queryLiterals(opts SearchOptions) []string {
+	if !opts.Regex {
+		return []string{opts.Pattern}
+	}
+	re, err := syntax.Parse(opts.Pattern, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	re = re.Simplify()
+	for re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	var lits []string
+	for _, s := range subs {
+		if s.Op == syntax.OpLiteral {
+			lits = append(lits, string(s.Rune))
+		}
+	}
+	return lits
+}
+
+// candidates returns the files that can match the search, sorted.
+func (idx *repoIndex) candidates(opts SearchOptions) []string {
+	var set map[string]bool
+	for _, lit := range queryLiterals(opts) {
+		for _, t := range trigrams([]byte(lit)) {
+			next := map[string]bool{}
+			for _, name := range idx.postings[t] {
+				if set == nil || set[name] {
+					next[name] = true
+				}
+			}
+			set = next
+		}
+	}
+
+	var names []string
+	if set == nil {
+		// no trigrams to filter with
+		for name, f := range idx.Files {
+			if f.Text {
+				names = append(names, name)
+			}
+		}
+	}
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// searchIndex greps the files of the indexed commit that contain the
+// trigrams of the search.
+func searchIndex(repoDir string, idx *repoIndex, opts SearchOptions, re *regexp.Regexp, deadline time.Time) SearchResult {
+	res := SearchResult{Options: opts}
+	r, err := git.PlainOpen(repoDir)
+	if err != nil {
+		slog.Error("git PlainOpen", "error", err.Error())
+		res.Error = "search failed"
+		return res
+	}
+	commit, err := r.CommitObject(idx.Commit)
+	if err != nil {
+		slog.Error("commit", "error", err.Error())
+		res.Error = "search failed"
+		return res
+	}
+
+	for _, name := range idx.candidates(opts) {
+		if time.Now().After(deadline) {
+			res.Truncated = true
+			break
+		}
+		if !opts.matchPath(name) {
+			continue
+		}
+		f, err := commit.File(name)
+		if err != nil {
+			slog.Error("file", "name", name, "error", err.Error())
+			continue
+		}
+		content, err := f.Contents()
+		if err != nil {
+			slog.Error("contents", "name", name, "error", err.Error())
+			continue
+		}
+
+		res.Files++
+		if err := searchFile(&res, name, []byte(content), re); err != nil {
+			res.Truncated = true
+			break
+		}
+	}
+	return res
+}
+
+// searchAll searches the indexes of all repositories the request can read.
+func (g *Gwi) searchAll(r *http.Request, opts SearchOptions) ([]RepoSearchResult, error) {
+	if opts.Pattern == "" {
+		return nil, nil
+	}
+	re, err := opts.regexp()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []RepoSearchResult
+	deadline := time.Now().Add(searchTimeout)
+	matches := 0
+	eachRepo(g.config.Root, func(user, repo string) {
+		if matches >= searchMaxMatches || time.Now().After(deadline) {
+			return
+		}
+		if !g.canRead(r, user, repo) {
+			return
+		}
+		repoDir := path.Join(g.config.Root, user, repo)
+		idx := loadIndex(repoDir)
+		if idx == nil {
+			return
+		}
+
+		res := searchIndex(repoDir, idx, opts, re, deadline)
+		if len(res.Matches) > 0 {
+			matches += len(res.Matches)
+			results = append(results, RepoSearchResult{User: user, Repo: displayName(repo), SearchResult: res})
+		}
+	})
+	return results, nil
+}
+
+// SearchHandler searches the code of all repositories, using their indexes,
+// it executes the global-search.html template with the query and results.
+// Private repositories are only searched if the request has the credentials
+// of their owner.
+func (g *Gwi) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("running search handler", "query", r.URL.RawQuery)
+
+	info := struct {
+		Query   url.Values
+		Results []RepoSearchResult
+		Error   string
+	}{Query: r.URL.Query()}
+
+	var err error
+	info.Results, err = g.searchAll(r, searchOptions(info.Query))
+	if err != nil {
+		info.Error = strings.TrimPrefix(err.Error(), "error parsing regexp: ")
+	}
+
+	pages, err := g.pages.get()
+	if err != nil {
+		g.httpError(w, r, err)
+		return
+	}
+	buf := bytes.Buffer{}
+	if err := pages.ExecuteTemplate(&buf, "global-search.html", info); err != nil {
+		g.httpError(w, r, fmt.Errorf("execute global-search.html: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(withParseError(buf.Bytes(), g.pages.parseError()))
+}
@@ -0,0 +1,140 @@
+package gwi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_Index(t *testing.T) {
+	root := t.TempDir()
+	pub := testRepo(t, root, "x", "proj")
+	testCommit(t, pub, map[string]string{
+		"main.go": "package main\n\nfunc Hello() {}\n",
+		"README":  "hi\n",
+	}, "init")
+	secret := testRepo(t, root, "y", "secret")
+	testCommit(t, secret, map[string]string{"hello.go": "package hello\n\nfunc Hello() {}\n"}, "init")
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetPrivate("y", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	g.indexRepos()
+	if _, err := os.Stat(path.Join(root, "x", "proj", indexFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := loadIndex(path.Join(root, "x", "proj"))
+	if got := idx.candidates(SearchOptions{Pattern: "hello"}); !reflect.DeepEqual(got, []string{"main.go"}) {
+		t.Errorf("candidates: %v", got)
+	}
+	if got := idx.candidates(SearchOptions{Pattern: `func \w+\(\)`, Regex: true}); !reflect.DeepEqual(got, []string{"main.go"}) {
+		t.Errorf("regex candidates: %v", got)
+	}
+	if got := idx.candidates(SearchOptions{Pattern: "h", Regex: true}); !reflect.DeepEqual(got, []string{"README", "main.go"}) {
+		t.Errorf("short candidates: %v", got)
+	}
+
+	// incremental update
+	testCommit(t, pub, map[string]string{
+		"main.go": "package main\n\nfunc Hello() {}\n",
+		"util.go": "package main\n\nfunc hello() {}\n",
+	}, "add util")
+	if err := g.updateIndex("x", "proj"); err != nil {
+		t.Fatal(err)
+	}
+	dropIndex(path.Join(root, "x", "proj"))
+	idx = loadIndex(path.Join(root, "x", "proj"))
+	if got := idx.candidates(SearchOptions{Pattern: "Hello"}); !reflect.DeepEqual(got, []string{"main.go", "util.go"}) {
+		t.Errorf("candidates after update: %v", got)
+	}
+
+	search := func(login, query string) string {
+		req := httptest.NewRequest(http.MethodGet, "/search?"+query, nil)
+		if login != "" {
+			req.SetBasicAuth(login, "1234")
+		}
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("search %s: got %d", query, rec.Code)
+		}
+		return rec.Body.String()
+	}
+	body := search("", "q=Hello")
+	if !strings.Contains(body, "main.go:3") || strings.Contains(body, "util.go") || strings.Contains(body, "secret") {
+		t.Errorf("public search:\n%s", body)
+	}
+	body = search("y", "q=hello&icase=on")
+	if !strings.Contains(body, "util.go:3") || !strings.Contains(body, "y/secret") {
+		t.Errorf("owner search:\n%s", body)
+	}
+	if body := search("", "q=(&regex=on"); !strings.Contains(body, "Error: missing closing )") {
+		t.Errorf("invalid regex:\n%s", body)
+	}
+
+	read := func(login string) int {
+		req := httptest.NewRequest(http.MethodGet, "/y/secret/summary", nil)
+		if login != "" {
+			req.SetBasicAuth(login, "1234")
+		}
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := read(""); code != http.StatusUnauthorized {
+		t.Errorf("anonymous read of private repo: %d", code)
+	}
+	if code := read("x"); code != http.StatusNotFound {
+		t.Errorf("read of private repo by other user: %d", code)
+	}
+}
+
+// Test_IndexMoved checks that a repository created where another one was
+// doesn't get its index.
+func Test_IndexMoved(t *testing.T) {
+	root := t.TempDir()
+	testCommit(t, testRepo(t, root, "x", "proj"), map[string]string{"old.go": "package old\n"}, "init")
+
+	g, err := NewFromConfig(Config{Root: root}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.updateIndex("x", "proj"); err != nil {
+		t.Fatal(err)
+	}
+	if loadIndex(path.Join(root, "x", "proj")) == nil {
+		t.Fatal("index not loaded")
+	}
+
+	for _, move := range []func() error{
+		func() error { return g.DeleteRepo("x", "proj") },
+		func() error { return g.RenameRepo("x", "proj", "app") },
+	} {
+		if err := move(); err != nil {
+			t.Fatal(err)
+		}
+		testCommit(t, testRepo(t, root, "x", "proj"), map[string]string{"new.go": "package new\n"}, "init")
+		if idx := loadIndex(path.Join(root, "x", "proj")); idx != nil {
+			t.Errorf("new repository has the index of the old one: %v", idx.Files)
+		}
+		if err := g.updateIndex("x", "proj"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx := loadIndex(path.Join(root, "x", "app"))
+	if idx == nil {
+		t.Fatal("moved repository lost its index")
+	}
+	if _, ok := idx.Files["new.go"]; !ok {
+		t.Errorf("moved repository has another index: %v", idx.Files)
+	}
+}
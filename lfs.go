@@ -0,0 +1,543 @@
+package gwi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	lfsDir       = "lfs"
+	lfsLocksFile = "locks.json"
+	lfsMediaType = "application/vnd.git-lfs+json"
+	lfsVersion   = "version https://git-lfs.github.com/spec/v1"
+
+	// lfsExpiry is the time clients can use the actions of a batch response.
+	lfsExpiry = time.Hour
+
+	// lfsMaxPointer is the size limit of pointer files.
+	lfsMaxPointer = 1024
+)
+
+var (
+	lfsOID = regexp.MustCompile("^[0-9a-f]{64}$")
+
+	lfsLockMu sync.Mutex
+)
+
+// LFSObject identifies a Git LFS object by the SHA256 of its content.
+type LFSObject struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// LFSAction tells the client where to transfer an object.
+type LFSAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int               `json:"expires_in,omitempty"`
+}
+
+// LFSError is the error of a single object on a batch response.
+type LFSError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// LFSBatchObject is an object on a batch response, objects that need no
+// transfer have no actions.
+type LFSBatchObject struct {
+	LFSObject
+	Authenticated bool                 `json:"authenticated,omitempty"`
+	Actions       map[string]LFSAction `json:"actions,omitempty"`
+	Error         *LFSError            `json:"error,omitempty"`
+}
+
+// LFSBatchRequest is the body of a request to the batch API.
+type LFSBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []LFSObject `json:"objects"`
+	HashAlgo  string      `json:"hash_algo"`
+}
+
+// LFSBatchResponse is the answer of the batch API, gwi only supports the
+// basic transfer adapter.
+type LFSBatchResponse struct {
+	Transfer string           `json:"transfer"`
+	Objects  []LFSBatchObject `json:"objects"`
+	HashAlgo string           `json:"hash_algo"`
+}
+
+// LFSLock is a lock held on a path of the repository, locks are kept in the
+// lfs/locks.json file of the repository.
+type LFSLock struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	LockedAt time.Time `json:"locked_at"`
+	Owner    struct {
+		Name string `json:"name"`
+	} `json:"owner"`
+}
+
+// lfsPath returns the file of the object oid, laid out as git-lfs does.
+func lfsPath(repoDir, oid string) string {
+	return path.Join(repoDir, lfsDir, "objects", oid[:2], oid[2:4], oid)
+}
+
+// lfsStat returns the size of the object oid, or -1 if it is not stored.
+func lfsStat(repoDir, oid string) int64 {
+	info, err := os.Stat(lfsPath(repoDir, oid))
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+// parseLFSPointer returns the object referenced by a pointer file, ok is
+// false if content is not a pointer.
+func parseLFSPointer(content []byte) (obj LFSObject, ok bool) {
+	if len(content) > lfsMaxPointer || !bytes.HasPrefix(content, []byte(lfsVersion+"\n")) {
+		return obj, false
+	}
+
+	obj.Size = -1
+	lines := bufio.NewScanner(bytes.NewReader(content))
+	for lines.Scan() {
+		key, value, _ := strings.Cut(lines.Text(), " ")
+		switch key {
+		case "oid":
+			obj.OID, _ = strings.CutPrefix(value, "sha256:")
+		case "size":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return obj, false
+			}
+			obj.Size = n
+		}
+	}
+	return obj, lfsOID.MatchString(obj.OID) && obj.Size >= 0
+}
+
+// lfsURL is the address of the LFS API of the repository, on the same base
+// as its clone URL.
+func (g *Gwi) lfsURL(r *http.Request, user, repo string) string {
+	return g.cloneURL(r, user, repo) + ".git/info/lfs"
+}
+
+func lfsReply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("encode lfs response", "error", err.Error())
+	}
+}
+
+func lfsFail(w http.ResponseWriter, status int, msg string) {
+	lfsReply(w, status, map[string]string{"message": msg})
+}
+
+// lfsDecode reads the JSON body of an API request into v.
+func lfsDecode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		lfsFail(w, http.StatusUnprocessableEntity, "invalid request: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// lfsBatchHandler answers the batch API, downloads need read access to the
+// repository and uploads the credentials of its owner, as pushes do.
+func (g *Gwi) lfsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	user, repo := vars["user"], vars["repo"]
+	slog.Debug("running lfs batch handler", "vars", vars)
+
+	var req LFSBatchRequest
+	if !lfsDecode(w, r, &req) {
+		return
+	}
+	switch req.Operation {
+	case "download":
+		if !g.readable(w, r, user, repo) {
+			return
+		}
+	case "upload":
+		if !g.authorize(w, r, user) {
+			return
+		}
+	default:
+		lfsFail(w, http.StatusUnprocessableEntity, "invalid operation "+req.Operation)
+		return
+	}
+	if req.HashAlgo != "" && req.HashAlgo != "sha256" {
+		lfsFail(w, http.StatusConflict, "unsupported hash algorithm "+req.HashAlgo)
+		return
+	}
+	if len(req.Transfers) > 0 && !contains(req.Transfers, "basic") {
+		lfsFail(w, http.StatusConflict, "only the basic transfer is supported")
+		return
+	}
+
+	repoDir := path.Join(g.config.Root, user, repo)
+	if _, err := os.Stat(repoDir); err != nil {
+		lfsFail(w, http.StatusNotFound, ErrRepoNotFound.Error())
+		return
+	}
+
+	// actions carry no credentials, clients send the ones they used on the
+	// batch request
+	base := g.lfsURL(r, user, repo)
+	res := LFSBatchResponse{Transfer: "basic", HashAlgo: "sha256"}
+	for _, obj := range req.Objects {
+		item := LFSBatchObject{LFSObject: obj}
+		action := LFSAction{
+			Href:      base + "/objects/" + obj.OID,
+			ExpiresIn: int(lfsExpiry.Seconds()),
+		}
+		size := int64(-1)
+		if lfsOID.MatchString(obj.OID) {
+			size = lfsStat(repoDir, obj.OID)
+		}
+
+		switch {
+		case !lfsOID.MatchString(obj.OID) || obj.Size < 0:
+			item.Error = &LFSError{http.StatusUnprocessableEntity, "invalid object"}
+		case req.Operation == "download" && size < 0:
+			item.Error = &LFSError{http.StatusNotFound, "object not found"}
+		case req.Operation == "download":
+			item.Size = size
+			item.Actions = map[string]LFSAction{"download": action}
+		case size != obj.Size:
+			verify := LFSAction{Href: base + "/verify", ExpiresIn: action.ExpiresIn}
+			item.Actions = map[string]LFSAction{"upload": action, "verify": verify}
+		}
+		res.Objects = append(res.Objects, item)
+	}
+	lfsReply(w, http.StatusOK, res)
+}
+
+// lfsObjectHandler downloads and uploads objects. Uploaded content must
+// match its OID.
+func (g *Gwi) lfsObjectHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	user, repo, oid := vars["user"], vars["repo"], vars["oid"]
+	slog.Debug("running lfs object handler", "method", r.Method, "vars", vars)
+
+	repoDir := path.Join(g.config.Root, user, repo)
+	if r.Method == http.MethodGet {
+		if !g.readable(w, r, user, repo) {
+			return
+		}
+		file, err := os.Open(lfsPath(repoDir, oid))
+		if err != nil {
+			lfsFail(w, http.StatusNotFound, "object not found")
+			return
+		}
+		defer file.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// objects are addressed by content, so they never change
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d, immutable", int(immutableTTL.Seconds())))
+		w.Header().Set("ETag", `"`+oid+`"`)
+		http.ServeContent(w, r, "", time.Time{}, file)
+		return
+	}
+
+	if !g.authorize(w, r, user) {
+		return
+	}
+	if _, err := os.Stat(repoDir); err != nil {
+		lfsFail(w, http.StatusNotFound, ErrRepoNotFound.Error())
+		return
+	}
+	if err := saveLFSObject(repoDir, oid, r.Body); err != nil {
+		slog.Error("save lfs object", "oid", oid, "error", err.Error())
+		lfsFail(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// saveLFSObject stores the content read from body as oid, the object is
+// only visible once it is complete and its hash is verified.
+func saveLFSObject(repoDir, oid string, body io.Reader) error {
+	file := lfsPath(repoDir, oid)
+	if err := os.MkdirAll(path.Dir(file), os.ModeDir|0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(path.Dir(file), "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), body); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != oid {
+		return fmt.Errorf("content does not match oid %s", oid)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// lfsVerifyHandler confirms that an upload is complete.
+func (g *Gwi) lfsVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !g.authorize(w, r, vars["user"]) {
+		return
+	}
+
+	var obj LFSObject
+	if !lfsDecode(w, r, &obj) {
+		return
+	}
+	if !lfsOID.MatchString(obj.OID) {
+		lfsFail(w, http.StatusUnprocessableEntity, "invalid object")
+		return
+	}
+	size := lfsStat(path.Join(g.config.Root, vars["user"], vars["repo"]), obj.OID)
+	if size < 0 {
+		lfsFail(w, http.StatusNotFound, "object not found")
+		return
+	}
+	if size != obj.Size {
+		lfsFail(w, http.StatusUnprocessableEntity, "object has size "+strconv.FormatInt(size, 10))
+		return
+	}
+	lfsReply(w, http.StatusOK, obj)
+}
+
+func readLFSLocks(repoDir string) ([]LFSLock, error) {
+	data, err := os.ReadFile(path.Join(repoDir, lfsDir, lfsLocksFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []LFSLock
+	err = json.Unmarshal(data, &locks)
+	return locks, err
+}
+
+func saveLFSLocks(repoDir string, locks []LFSLock) error {
+	dir := path.Join(repoDir, lfsDir)
+	if err := os.MkdirAll(dir, os.ModeDir|0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(locks)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(dir, lfsLocksFile), data, 0o600)
+}
+
+// pageLocks returns the locks after cursor, which is the ID of the first
+// lock of the page, and the cursor of the next page.
+func pageLocks(locks []LFSLock, cursor, limit string) ([]LFSLock, string) {
+	sort.Slice(locks, func(i, j int) bool { return locks[i].ID < locks[j].ID })
+	if cursor != "" {
+		i := sort.Search(len(locks), func(i int) bool { return locks[i].ID >= cursor })
+		locks = locks[i:]
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 || n >= len(locks) {
+		return locks, ""
+	}
+	return locks[:n], locks[n].ID
+}
+
+// lfsLocksHandler lists the locks of the repository with GET, and creates
+// one with POST.
+func (g *Gwi) lfsLocksHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	user, repo := vars["user"], vars["repo"]
+	slog.Debug("running lfs locks handler", "method", r.Method, "vars", vars)
+	repoDir := path.Join(g.config.Root, user, repo)
+
+	if r.Method == http.MethodGet {
+		if !g.readable(w, r, user, repo) {
+			return
+		}
+		lfsLockMu.Lock()
+		locks, err := readLFSLocks(repoDir)
+		lfsLockMu.Unlock()
+		if err != nil {
+			slog.Error("read lfs locks", "error", err.Error())
+			lfsFail(w, http.StatusInternalServerError, "error reading locks")
+			return
+		}
+
+		query := r.URL.Query()
+		var found []LFSLock
+		for _, l := range locks {
+			if (query.Get("path") == "" || query.Get("path") == l.Path) &&
+				(query.Get("id") == "" || query.Get("id") == l.ID) {
+				found = append(found, l)
+			}
+		}
+		page, next := pageLocks(found, query.Get("cursor"), query.Get("limit"))
+		lfsReply(w, http.StatusOK, map[string]any{"locks": nonNil(page), "next_cursor": next})
+		return
+	}
+
+	login, ok := g.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if login != owner(user) {
+		lfsFail(w, http.StatusForbidden, "only the owner can lock files")
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+	}
+	if !lfsDecode(w, r, &req) {
+		return
+	}
+	if req.Path == "" {
+		lfsFail(w, http.StatusUnprocessableEntity, "missing path")
+		return
+	}
+
+	lfsLockMu.Lock()
+	defer lfsLockMu.Unlock()
+
+	locks, err := readLFSLocks(repoDir)
+	if err != nil {
+		slog.Error("read lfs locks", "error", err.Error())
+		lfsFail(w, http.StatusInternalServerError, "error reading locks")
+		return
+	}
+	for _, l := range locks {
+		if l.Path == req.Path {
+			lfsReply(w, http.StatusConflict, map[string]any{"lock": l, "message": "already locked"})
+			return
+		}
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	lock := LFSLock{ID: hex.EncodeToString(id), Path: req.Path, LockedAt: time.Now().UTC()}
+	lock.Owner.Name = login
+	if err := saveLFSLocks(repoDir, append(locks, lock)); err != nil {
+		slog.Error("save lfs locks", "error", err.Error())
+		lfsFail(w, http.StatusInternalServerError, "error saving lock")
+		return
+	}
+	lfsReply(w, http.StatusCreated, map[string]any{"lock": lock})
+}
+
+// lfsVerifyLocksHandler lists the locks split between the ones held by the
+// authenticated user and the others, git-lfs calls it before pushing.
+func (g *Gwi) lfsVerifyLocksHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !g.authorize(w, r, vars["user"]) {
+		return
+	}
+	login, _, _ := r.BasicAuth()
+
+	var req struct {
+		Cursor string `json:"cursor"`
+		Limit  int    `json:"limit"`
+	}
+	if !lfsDecode(w, r, &req) {
+		return
+	}
+
+	lfsLockMu.Lock()
+	locks, err := readLFSLocks(path.Join(g.config.Root, vars["user"], vars["repo"]))
+	lfsLockMu.Unlock()
+	if err != nil {
+		slog.Error("read lfs locks", "error", err.Error())
+		lfsFail(w, http.StatusInternalServerError, "error reading locks")
+		return
+	}
+
+	page, next := pageLocks(locks, req.Cursor, strconv.Itoa(req.Limit))
+	ours, theirs := []LFSLock{}, []LFSLock{}
+	for _, l := range page {
+		if l.Owner.Name == login {
+			ours = append(ours, l)
+		} else {
+			theirs = append(theirs, l)
+		}
+	}
+	lfsReply(w, http.StatusOK, map[string]any{"ours": ours, "theirs": theirs, "next_cursor": next})
+}
+
+// lfsUnlockHandler removes a lock, locks of other users need force.
+func (g *Gwi) lfsUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !g.authorize(w, r, vars["user"]) {
+		return
+	}
+	login, _, _ := r.BasicAuth()
+
+	var req struct {
+		Force bool `json:"force"`
+	}
+	if !lfsDecode(w, r, &req) {
+		return
+	}
+
+	lfsLockMu.Lock()
+	defer lfsLockMu.Unlock()
+
+	repoDir := path.Join(g.config.Root, vars["user"], vars["repo"])
+	locks, err := readLFSLocks(repoDir)
+	if err != nil {
+		slog.Error("read lfs locks", "error", err.Error())
+		lfsFail(w, http.StatusInternalServerError, "error reading locks")
+		return
+	}
+	for i, l := range locks {
+		if l.ID != vars["id"] {
+			continue
+		}
+		if l.Owner.Name != login && !req.Force {
+			lfsFail(w, http.StatusForbidden, "lock is owned by "+l.Owner.Name)
+			return
+		}
+		if err := saveLFSLocks(repoDir, append(locks[:i], locks[i+1:]...)); err != nil {
+			slog.Error("save lfs locks", "error", err.Error())
+			lfsFail(w, http.StatusInternalServerError, "error saving locks")
+			return
+		}
+		lfsReply(w, http.StatusOK, map[string]any{"lock": l})
+		return
+	}
+	lfsFail(w, http.StatusNotFound, "lock not found")
+}
+
+func nonNil(locks []LFSLock) []LFSLock {
+	if locks == nil {
+		return []LFSLock{}
+	}
+	return locks
+}
@@ -0,0 +1,196 @@
+package gwi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_LFS(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+
+	content := "\x00\x01binary content"
+	sum := sha256.Sum256([]byte(content))
+	oid := hex.EncodeToString(sum[:])
+	pointer := fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsVersion, oid, len(content))
+	testCommit(t, repo, map[string]string{"data.bin": pointer}, "add data")
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(g.Handle())
+	defer srv.Close()
+	api := srv.URL + "/x/proj.git/info/lfs"
+
+	do := func(method, url, login, body string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Accept", lfsMediaType)
+		if login != "" {
+			req.SetBasicAuth(login, "1234")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		return res, string(data)
+	}
+	batch := func(op, login string) (int, LFSBatchObject) {
+		t.Helper()
+		body := fmt.Sprintf(`{"operation":%q,"transfers":["basic"],"objects":[{"oid":%q,"size":%d}]}`, op, oid, len(content))
+		res, data := do(http.MethodPost, api+"/objects/batch", login, body)
+		var out LFSBatchResponse
+		json.Unmarshal([]byte(data), &out)
+		if res.StatusCode != http.StatusOK {
+			return res.StatusCode, LFSBatchObject{}
+		}
+		return res.StatusCode, out.Objects[0]
+	}
+
+	if code, _ := batch("upload", ""); code != http.StatusUnauthorized {
+		t.Errorf("anonymous upload: %d", code)
+	}
+	if code, _ := batch("upload", "y"); code != http.StatusUnauthorized {
+		t.Errorf("upload by another user: %d", code)
+	}
+	if _, obj := batch("download", ""); obj.Error == nil || obj.Error.Code != http.StatusNotFound {
+		t.Errorf("download of missing object: %+v", obj)
+	}
+
+	_, obj := batch("upload", "x")
+	upload, verify := obj.Actions["upload"], obj.Actions["verify"]
+	if upload.Href != api+"/objects/"+oid || verify.Href != api+"/verify" {
+		t.Fatalf("upload actions: %+v", obj)
+	}
+	if upload.Header != nil || verify.Header != nil || obj.Authenticated {
+		t.Errorf("actions carry credentials: %+v", obj)
+	}
+	if res, _ := do(http.MethodPut, upload.Href, "x", "other content"); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("upload of wrong content: %d", res.StatusCode)
+	}
+	if res, _ := do(http.MethodPut, upload.Href, "x", content); res.StatusCode != http.StatusOK {
+		t.Errorf("upload: %d", res.StatusCode)
+	}
+	body := fmt.Sprintf(`{"oid":%q,"size":%d}`, oid, len(content))
+	if res, data := do(http.MethodPost, verify.Href, "x", body); res.StatusCode != http.StatusOK {
+		t.Errorf("verify: %d %s", res.StatusCode, data)
+	}
+	if _, obj := batch("upload", "x"); obj.Actions != nil {
+		t.Errorf("stored object is uploaded again: %+v", obj)
+	}
+
+	_, obj = batch("download", "")
+	if res, data := do(http.MethodGet, obj.Actions["download"].Href, "", ""); res.StatusCode != http.StatusOK || data != content {
+		t.Errorf("download: %d %q", res.StatusCode, data)
+	}
+	res, data := do(http.MethodGet, srv.URL+"/x/proj/raw/data.bin", "", "")
+	if data != content || res.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("raw pointer: %q %v", data, res.Header)
+	}
+
+	// links use the configured domain, as clone URLs do
+	withDomain, err := NewFromConfig(Config{Root: root, PagesRoot: "templates", Domain: "git.example.com"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/x/proj.git/info/lfs/objects/batch", strings.NewReader(
+		fmt.Sprintf(`{"operation":"download","objects":[{"oid":%q,"size":%d}]}`, oid, len(content)),
+	))
+	req.Header.Set("Accept", lfsMediaType)
+	rec := httptest.NewRecorder()
+	withDomain.Handle().ServeHTTP(rec, req)
+	if want := "http://git.example.com/x/proj.git/info/lfs/objects/" + oid; !strings.Contains(rec.Body.String(), `"href":"`+want+`"`) {
+		t.Errorf("download with domain: %s", rec.Body)
+	}
+
+	if err := g.SetPrivate("x", "proj", true); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := batch("download", ""); code != http.StatusUnauthorized {
+		t.Errorf("anonymous download of private repo: %d", code)
+	}
+	if code, _ := batch("download", "x"); code != http.StatusOK {
+		t.Errorf("owner download of private repo: %d", code)
+	}
+}
+
+func Test_LFSLocks(t *testing.T) {
+	root := t.TempDir()
+	testRepo(t, root, "x", "proj")
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(method, url, login, body string, v any) int {
+		t.Helper()
+		req := httptest.NewRequest(method, "/x/proj/info/lfs"+url, strings.NewReader(body))
+		if login != "" {
+			req.SetBasicAuth(login, "1234")
+		}
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, req)
+		if v != nil {
+			json.Unmarshal(rec.Body.Bytes(), v)
+		}
+		return rec.Code
+	}
+
+	if code := call(http.MethodPost, "/locks", "y", `{"path":"a.bin"}`, nil); code != http.StatusForbidden {
+		t.Errorf("lock by another user: %d", code)
+	}
+	var created struct{ Lock LFSLock }
+	if code := call(http.MethodPost, "/locks", "x", `{"path":"a.bin"}`, &created); code != http.StatusCreated {
+		t.Fatalf("lock: %d", code)
+	}
+	if created.Lock.Path != "a.bin" || created.Lock.Owner.Name != "x" {
+		t.Errorf("lock: %+v", created.Lock)
+	}
+	if code := call(http.MethodPost, "/locks", "x", `{"path":"a.bin"}`, nil); code != http.StatusConflict {
+		t.Errorf("second lock: %d", code)
+	}
+	call(http.MethodPost, "/locks", "x", `{"path":"b.bin"}`, nil)
+
+	var list struct {
+		Locks      []LFSLock
+		NextCursor string `json:"next_cursor"`
+	}
+	call(http.MethodGet, "/locks?path=a.bin", "", "", &list)
+	if len(list.Locks) != 1 || list.Locks[0].ID != created.Lock.ID {
+		t.Errorf("locks of a.bin: %+v", list)
+	}
+	call(http.MethodGet, "/locks?limit=1", "", "", &list)
+	if len(list.Locks) != 1 || list.NextCursor == "" {
+		t.Errorf("first page: %+v", list)
+	}
+	call(http.MethodGet, "/locks?limit=1&cursor="+list.NextCursor, "", "", &list)
+	if len(list.Locks) != 1 || list.NextCursor != "" {
+		t.Errorf("last page: %+v", list)
+	}
+
+	var verify struct{ Ours, Theirs []LFSLock }
+	if code := call(http.MethodPost, "/locks/verify", "x", `{}`, &verify); code != http.StatusOK || len(verify.Ours) != 2 {
+		t.Errorf("verify: %d %+v", code, verify)
+	}
+
+	unlock := "/locks/" + created.Lock.ID + "/unlock"
+	if code := call(http.MethodPost, unlock, "y", `{}`, nil); code != http.StatusUnauthorized {
+		t.Errorf("unlock by another user: %d", code)
+	}
+	if code := call(http.MethodPost, unlock, "x", `{}`, nil); code != http.StatusOK {
+		t.Errorf("unlock: %d", code)
+	}
+	if code := call(http.MethodPost, unlock, "x", `{}`, nil); code != http.StatusNotFound {
+		t.Errorf("unlock twice: %d", code)
+	}
+}
@@ -0,0 +1,223 @@
+package gwi
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// logMaxCommits limits the commits listed by log and logsearch, history
+// searches also stop after logTimeout.
+const (
+	logMaxCommits = 500
+	logTimeout    = 5 * time.Second
+)
+
+var errLogLimit = errors.New("log limit reached")
+
+// LogQuery selects commits in a history search, all fields given must match.
+// Message is a case-insensitive regex matched against the commit message,
+// Author is matched against the name and email of the author, Path selects
+// commits that changed files under it, and Pickaxe, like git log -S, selects
+// commits that changed the number of occurrences of a string.
+type LogQuery struct {
+	Message string
+	Author  string
+	Path    string
+	Pickaxe string
+}
+
+// logQuery reads a history search from the query of a request, using the
+// parameters q, author, path and s.
+func logQuery(query url.Values) LogQuery {
+	return LogQuery{
+		Message: query.Get("q"),
+		Author:  query.Get("author"),
+		Path:    strings.Trim(query.Get("path"), "/"),
+		Pickaxe: query.Get("s"),
+	}
+}
+
+// LogSearchResult holds the commits found by a history search, Truncated
+// tells whether it stopped at logMaxCommits commits or after logTimeout.
+type LogSearchResult struct {
+	Query     LogQuery
+	Commits   []*object.Commit
+	Truncated bool
+}
+
+func (q LogQuery) empty() bool {
+	return q == LogQuery{}
+}
+
+func underPath(name, dir string) bool {
+	return dir == "" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// logCommits walks the history from ref, or HEAD if ref is zero, calling f
+// for every commit until it returns an error. If deadline is not zero the
+// walk stops with errLogLimit once it passes, also while looking for commits
+// that changed path, which go-git does without calling f.
+func logCommits(repo *git.Repository, ref plumbing.Hash, path string, deadline time.Time, f func(*object.Commit) error) error {
+	if ref.IsZero() {
+		head, err := repo.Head()
+		if err != nil {
+			return err
+		}
+		ref = head.Hash()
+	}
+	expired := func() bool {
+		return !deadline.IsZero() && time.Now().After(deadline)
+	}
+
+	opts := &git.LogOptions{From: ref}
+	if path != "" {
+		// an expired walk is let through so f can stop it
+		opts.PathFilter = func(name string) bool { return expired() || underPath(name, path) }
+	}
+	iter, err := repo.Log(opts)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	err = iter.ForEach(func(c *object.Commit) error {
+		if expired() {
+			return errLogLimit
+		}
+		return f(c)
+	})
+	if err == storer.ErrStop {
+		return nil
+	}
+	return err
+}
+
+// pickaxe tells whether c changed the number of occurrences of s in the
+// files under path.
+func pickaxe(c *object.Commit, s, path string) (bool, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return false, err
+	}
+	parentTree := &object.Tree{}
+	if c.NumParents() > 0 {
+		parent, err := c.Parent(0)
+		if err != nil {
+			return false, err
+		}
+		if parentTree, err = parent.Tree(); err != nil {
+			return false, err
+		}
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return false, err
+	}
+	for _, ch := range changes {
+		if !underPath(ch.From.Name, path) && !underPath(ch.To.Name, path) {
+			continue
+		}
+		from, to, err := ch.Files()
+		if err != nil {
+			return false, err
+		}
+		if count(from, s) != count(to, s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func count(f *object.File, s string) int {
+	if f == nil || f.Size > searchMaxFileSize {
+		return 0
+	}
+	content, err := f.Contents()
+	if err != nil || isBinary([]byte(content)) {
+		return 0
+	}
+	return strings.Count(content, s)
+}
+
+// log lists the commits reachable from ref, newest first.
+func (g *Gwi) log(repo *git.Repository) func(ref plumbing.Hash) []*object.Commit {
+	return func(ref plumbing.Hash) []*object.Commit {
+		slog.Debug("getting log", "ref", ref.String())
+		var commits []*object.Commit
+		err := logCommits(repo, ref, "", time.Time{}, func(c *object.Commit) error {
+			if len(commits) == logMaxCommits {
+				return storer.ErrStop
+			}
+			commits = append(commits, c)
+			return nil
+		})
+		if err != nil {
+			slog.Error("log", "error", err.Error())
+		}
+		return commits
+	}
+}
+
+// logsearch lists the commits reachable from ref that match the history
+// search given by query, see [LogQuery].
+func (g *Gwi) logsearch(repo *git.Repository) func(ref plumbing.Hash, query url.Values) LogSearchResult {
+	return func(ref plumbing.Hash, query url.Values) LogSearchResult {
+		q := logQuery(query)
+		slog.Debug("searching log", "ref", ref.String(), "query", q)
+		if q.empty() {
+			return LogSearchResult{Query: q}
+		}
+		return searchLog(repo, ref, q, time.Now().Add(logTimeout))
+	}
+}
+
+func searchLog(repo *git.Repository, ref plumbing.Hash, q LogQuery, deadline time.Time) LogSearchResult {
+	var msg *regexp.Regexp
+	if q.Message != "" {
+		var err error
+		msg, err = regexp.Compile("(?i)" + q.Message)
+		if err != nil {
+			msg = regexp.MustCompile("(?i)" + regexp.QuoteMeta(q.Message))
+		}
+	}
+	author := strings.ToLower(q.Author)
+
+	res := LogSearchResult{Query: q}
+	err := logCommits(repo, ref, q.Path, deadline, func(c *object.Commit) error {
+		if len(res.Commits) == logMaxCommits {
+			return errLogLimit
+		}
+		if msg != nil && !msg.MatchString(c.Message) {
+			return nil
+		}
+		if author != "" &&
+			!strings.Contains(strings.ToLower(c.Author.Name), author) &&
+			!strings.Contains(strings.ToLower(c.Author.Email), author) {
+			return nil
+		}
+		if q.Pickaxe != "" {
+			changed, err := pickaxe(c, q.Pickaxe, q.Path)
+			if err != nil || !changed {
+				return err
+			}
+		}
+		res.Commits = append(res.Commits, c)
+		return nil
+	})
+	res.Truncated = err == errLogLimit
+	if err != nil && err != errLogLimit {
+		slog.Error("log search", "error", err.Error())
+	}
+	return res
+}
@@ -0,0 +1,72 @@
+package gwi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func Test_LogSearch(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	testCommit(t, repo, map[string]string{"README": "hello\n"}, "Initial commit")
+	testCommit(t, repo, map[string]string{"README": "hello\n", "src/a.go": "var token = 1\n"}, "Add token")
+	testCommit(t, repo, map[string]string{"README": "hello world\n", "src/a.go": "var token = 2\n"}, "Fix README")
+	testCommit(t, repo, map[string]string{"README": "hello world\n", "src/a.go": "var x = 2\n"}, "Remove token")
+
+	logsearch := (&Gwi{}).logsearch(repo)
+	tests := []struct {
+		query url.Values
+		want  []string
+	}{
+		{url.Values{"q": {"token"}}, []string{"Remove token", "Add token"}},
+		{url.Values{"q": {"^(fix|initial)"}}, []string{"Fix README", "Initial commit"}},
+		{url.Values{"author": {"TEST"}, "q": {"readme"}}, []string{"Fix README"}},
+		{url.Values{"author": {"nobody"}}, nil},
+		{url.Values{"path": {"src"}}, []string{"Remove token", "Fix README", "Add token"}},
+		{url.Values{"s": {"token"}}, []string{"Remove token", "Add token"}},
+		{url.Values{"s": {"world"}, "path": {"src"}}, nil},
+		{url.Values{}, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		res := logsearch(plumbing.ZeroHash, tt.query)
+		if res.Truncated {
+			t.Errorf("%v: truncated", tt.query)
+		}
+		for _, c := range res.Commits {
+			got = append(got, strings.TrimSpace(c.Message))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// the deadline also stops walks looking for changes under a path
+	for _, q := range []LogQuery{{Path: "nothing"}, {Message: "token"}} {
+		if res := searchLog(repo, plumbing.ZeroHash, q, time.Now()); !res.Truncated || len(res.Commits) != 0 {
+			t.Errorf("%+v after deadline: %+v", q, res)
+		}
+	}
+
+	if commits := (&Gwi{}).log(repo)(plumbing.ZeroHash); len(commits) != 4 {
+		t.Errorf("log has %d commits", len(commits))
+	}
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/x/proj/log?s=token", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, "Add token") || strings.Contains(body, "Fix README") {
+		t.Errorf("log page:\n%s", body)
+	}
+}
@@ -0,0 +1,418 @@
+package gwi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Mailing lists are stored inside the bare repository, in the mail folder.
+// Each thread is a folder named after its title, and every message is kept
+// as received, in its own file, like in a maildir. File names start with the
+// time the message arrived so they sort in order.
+const (
+	mailDir   = "mail"
+	stateFile = ".state"
+)
+
+// Thread is a discussion on the mailing list of a repository.
+type Thread struct {
+	Title   string
+	LastMod time.Time
+	Mails   int
+	ThreadState
+}
+
+// ThreadState holds the status of a thread, changed by commands sent by
+// mail, see [Command]. It is saved on the .state file of the thread.
+type ThreadState struct {
+	Closed bool
+	Labels []string
+}
+
+// Mail is a message of a thread, patches sent with git format-patch, inline
+// or as attachments, are parsed into Patches.
+type Mail struct {
+	ID          string
+	From        string
+	Subject     string
+	Date        time.Time
+	Body        string
+	Attachments []Attachment
+	Patches     []*Patch
+}
+
+// Attachment is a file attached to a mail, Data is encoded in base64.
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        string
+}
+
+var replyPrefix = regexp.MustCompile(`^(?i)((re|fwd?|aw):\s*)+`)
+
+var wordDecoder = mime.WordDecoder{}
+
+func decodeHeader(h string) string {
+	dec, err := wordDecoder.DecodeHeader(h)
+	if err != nil {
+		return h
+	}
+	return dec
+}
+
+// threadName gives the title of the thread a mail with subject belongs to,
+// it is used as folder name so subjects that make no valid name, like "-",
+// go to the "no subject" thread.
+func threadName(subject string) string {
+	name := replyPrefix.ReplaceAllString(strings.TrimSpace(decodeHeader(subject)), "")
+	name = strings.NewReplacer("/", "-", "\\", "-", "\n", " ", "\r", "").Replace(name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if len(name) > 128 {
+		// cut at the start of a rune
+		end := 128
+		for end > 0 && !utf8.RuneStart(name[end]) {
+			end--
+		}
+		name = strings.TrimSpace(name[:end])
+	}
+	if !validName(name) {
+		name = "no subject"
+	}
+	return name
+}
+
+// saveMail stores a raw message on a thread, the thread is created if needed.
+func saveMail(repoDir, thread string, raw []byte) error {
+	if !validName(thread) {
+		return ErrInvalidName
+	}
+	dir := path.Join(repoDir, mailDir, thread)
+	if err := os.MkdirAll(dir, os.ModeDir|0o700); err != nil {
+		return err
+	}
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	name := fmt.Sprintf("%d.%s", time.Now().UnixNano(), hex.EncodeToString(id))
+
+	// write to a hidden file first so readers never see partial messages
+	tmp := path.Join(dir, "."+name)
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, name))
+}
+
+func readThreads(repoDir string) ([]Thread, error) {
+	dirs, err := os.ReadDir(path.Join(repoDir, mailDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var threads []Thread
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		files, err := mailFiles(path.Join(repoDir, mailDir, d.Name()))
+		if err != nil {
+			return threads, err
+		}
+
+		t := Thread{Title: d.Name(), Mails: len(files)}
+		t.ThreadState, err = readThreadState(repoDir, d.Name())
+		if err != nil {
+			return threads, err
+		}
+		for _, f := range files {
+			if info, err := f.Info(); err == nil && info.ModTime().After(t.LastMod) {
+				t.LastMod = info.ModTime()
+			}
+		}
+		threads = append(threads, t)
+	}
+
+	sort.Slice(threads, func(i, j int) bool {
+		return threads[i].LastMod.After(threads[j].LastMod)
+	})
+	return threads, nil
+}
+
+func (s ThreadState) hasLabel(label string) bool {
+	return contains(s.Labels, label)
+}
+
+func readThreadState(repoDir, thread string) (ThreadState, error) {
+	state := ThreadState{}
+	data, err := os.ReadFile(path.Join(repoDir, mailDir, thread, stateFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func saveThreadState(repoDir, thread string, state ThreadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(repoDir, mailDir, thread, stateFile), data, 0o600)
+}
+
+func mailFiles(dir string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []os.DirEntry
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			files = append(files, e)
+		}
+	}
+	return files, nil
+}
+
+func readMails(repoDir, thread string) ([]Mail, error) {
+	if !validName(thread) {
+		return nil, ErrInvalidName
+	}
+	dir := path.Join(repoDir, mailDir, thread)
+	files, err := mailFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var mails []Mail
+	for _, f := range files {
+		raw, err := os.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return mails, err
+		}
+		m, err := parseMail(raw)
+		if err != nil {
+			slog.Error("parse mail", "file", f.Name(), "error", err.Error())
+			continue
+		}
+		mails = append(mails, m)
+	}
+	return mails, nil
+}
+
+// parseMail reads a RFC 5322 message, the first text part is the body and
+// the others are attachments.
+func parseMail(raw []byte) (Mail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return Mail{}, err
+	}
+
+	m := Mail{
+		ID:      strings.Trim(msg.Header.Get("Message-Id"), "<> "),
+		From:    decodeHeader(msg.Header.Get("From")),
+		Subject: decodeHeader(msg.Header.Get("Subject")),
+	}
+	m.Date, _ = msg.Header.Date()
+
+	var patches []string
+	err = readPart(
+		&m,
+		&patches,
+		msg.Header.Get("Content-Type"),
+		msg.Header.Get("Content-Transfer-Encoding"),
+		"",
+		msg.Body,
+	)
+	if err != nil {
+		return m, err
+	}
+
+	if isPatch(m.Body) {
+		patches = append([]string{m.Body}, patches...)
+	}
+	for _, text := range patches {
+		p, err := parsePatch(text, msg.Header)
+		if err != nil {
+			slog.Info("parse patch", "mail", m.ID, "error", err.Error())
+			continue
+		}
+		m.Patches = append(m.Patches, p)
+	}
+	return m, nil
+}
+
+func readPart(m *Mail, patches *[]string, contentType, encoding, disposition string, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = readPart(
+				m,
+				patches,
+				part.Header.Get("Content-Type"),
+				part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"),
+				part,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(encoding) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	_, dispParams, _ := mime.ParseMediaType(disposition)
+	name := dispParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	// mails travel with CRLF line endings, but patches need plain LF
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if mediaType == "text/plain" && name == "" && m.Body == "" {
+		m.Body = text
+		return nil
+	}
+
+	if name == "" {
+		name = fmt.Sprintf("attachment-%d", len(m.Attachments)+1)
+	}
+	m.Attachments = append(m.Attachments, Attachment{
+		Name:        name,
+		ContentType: mediaType,
+		Data:        base64.StdEncoding.EncodeToString(data),
+	})
+
+	isPatchFile := strings.HasSuffix(name, ".patch") || strings.HasSuffix(name, ".diff")
+	if strings.HasPrefix(mediaType, "text/") && isPatchFile || mediaType == "text/x-patch" ||
+		mediaType == "text/x-diff" || mediaType == "application/mbox" {
+		*patches = append(*patches, text)
+	}
+	return nil
+}
+
+// checkPatches applies the patches of a thread, in order, on top of the
+// commit ref, filling the Error field of those that do not apply.
+func checkPatches(repo *git.Repository, ref plumbing.Hash, mails []Mail) {
+	var tree *object.Tree
+	commit, err := repo.CommitObject(ref)
+	if err == nil {
+		tree, err = commit.Tree()
+	}
+	if err != nil {
+		slog.Error("patch base", "ref", ref.String(), "error", err.Error())
+	}
+
+	pt := newPatchTree(tree)
+	for _, m := range mails {
+		for _, p := range m.Patches {
+			if err := pt.apply(p); err != nil {
+				p.Error = err.Error()
+			}
+		}
+	}
+}
+
+// threads lists the threads of the repository's mailing list, the most
+// recently updated first. Filters select threads that are open, closed or
+// have a given label, all filters must match.
+func (g *Gwi) threads(repoDir string) func(filters ...string) []Thread {
+	return func(filters ...string) []Thread {
+		slog.Debug("getting threads", "repo", repoDir, "filters", filters)
+		threads, err := readThreads(repoDir)
+		if err != nil {
+			slog.Error("threads", "error", err.Error())
+		}
+
+		var selected []Thread
+		for _, t := range threads {
+			match := true
+			for _, f := range filters {
+				switch f {
+				case "open":
+					match = match && !t.Closed
+				case "closed":
+					match = match && t.Closed
+				default:
+					match = match && t.hasLabel(f)
+				}
+			}
+			if match {
+				selected = append(selected, t)
+			}
+		}
+		return selected
+	}
+}
+
+// mails returns the messages of a thread, patches found on them are checked
+// against the HEAD of the repository.
+func (g *Gwi) mails(repo *git.Repository, repoDir string) func(thread string) []Mail {
+	return func(thread string) []Mail {
+		slog.Debug("getting mails", "thread", thread)
+		mails, err := readMails(repoDir, thread)
+		if err != nil {
+			slog.Error("mails", "error", err.Error())
+			return mails
+		}
+
+		head, err := repo.Head()
+		if err != nil {
+			slog.Error("head", "error", err.Error())
+			return mails
+		}
+		checkPatches(repo, head.Hash(), mails)
+		return mails
+	}
+}
@@ -0,0 +1,151 @@
+package gwi
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+const testPatch1 = `From: Ann Dev <ann@localhost>
+Date: Sun, 18 Oct 2026 21:41:58 +0000
+Subject: [PATCH 1/2] Add there
+Message-Id: <1@localhost>
+
+---
+ README | 1 +
+ 1 file changed, 1 insertion(+)
+
+diff --git a/README b/README
+index 94954ab..363f0a5 100644
+--- a/README
++++ b/README
+@@ -1,2 +1,3 @@
+ hello
++there
+ world
+-- 
+2.39.5
+`
+
+const testPatch2 = `From: Ann Dev <ann@localhost>
+Date: Sun, 18 Oct 2026 21:45:00 +0000
+Subject: Re: [PATCH 1/2] Add there
+Message-Id: <2@localhost>
+In-Reply-To: <1@localhost>
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="b"
+
+--b
+Content-Type: text/plain
+
+The second one is attached.
+--b
+Content-Type: text/x-patch; name="0002-Add-main.patch"
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="0002-Add-main.patch"
+
+RnJvbSA0ZjA1YmRmMmI3NDMyOTllNGIxMWUyYjZjODBmN2FmOGRjNzAyOTBiIE1vbiBTZXAgMTcg
+MDA6MDA6MDAgMjAwMQpGcm9tOiBBbm4gRGV2IDxhQGIuYz4KRGF0ZTogU3VuLCAxOCBPY3QgMjAy
+NiAyMTo0MTo1OCArMDAwMApTdWJqZWN0OiBbUEFUQ0ggMi8yXSBBZGQgbWFpbgoKV2l0aCBhIGJv
+ZHkuCi0tLQogUkVBRE1FICB8IDEgKwogbWFpbi5nbyB8IDEgKwogMiBmaWxlcyBjaGFuZ2VkLCAy
+IGluc2VydGlvbnMoKykKIGNyZWF0ZSBtb2RlIDEwMDY0NCBtYWluLmdvCgpkaWZmIC0tZ2l0IGEv
+UkVBRE1FIGIvUkVBRE1FCmluZGV4IDM2M2YwYTUuLjE2OGUwNjQgMTAwNjQ0Ci0tLSBhL1JFQURN
+RQorKysgYi9SRUFETUUKQEAgLTEsMyArMSw0IEBACiBoZWxsbwogdGhlcmUKIHdvcmxkCishCmRp
+ZmYgLS1naXQgYS9tYWluLmdvIGIvbWFpbi5nbwpuZXcgZmlsZSBtb2RlIDEwMDY0NAppbmRleCAw
+MDAwMDAwLi4wNmFiN2QwCi0tLSAvZGV2L251bGwKKysrIGIvbWFpbi5nbwpAQCAtMCwwICsxIEBA
+CitwYWNrYWdlIG1haW4KLS0gCjIuMzkuNQoK
+--b--
+`
+
+const testPatchConflict = `From: Bob <bob@localhost>
+Subject: [PATCH] Replace world
+
+diff --git a/README b/README
+--- a/README
++++ b/README
+@@ -1,2 +1,2 @@
+ hello
+-planet
++earth
+`
+
+func Test_ThreadName(t *testing.T) {
+	long := strings.Repeat("é", 100)
+	tests := map[string]string{
+		"Re: [PATCH] Add there": "[PATCH] Add there",
+		"a/b\\c":                "a-b-c",
+		"-":                     "no subject",
+		"Re: -":                 "no subject",
+		"/":                     "no subject",
+		"...":                   "no subject",
+		"":                      "no subject",
+		long:                    long[:128],
+		"a" + long:              "a" + long[:126],
+	}
+	repoDir := t.TempDir()
+	for subject, want := range tests {
+		got := threadName(subject)
+		if got != want {
+			t.Errorf("%q: got %q, want %q", subject, got, want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%q: invalid UTF-8 %q", subject, got)
+		}
+		if err := saveMail(repoDir, got, []byte("Subject: x\n\nx\n")); err != nil {
+			t.Errorf("%q: %s", subject, err)
+		}
+	}
+}
+
+func Test_Mails(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	testCommit(t, repo, map[string]string{"README": "hello\nworld\n"}, "init")
+	repoDir := path.Join(root, "x", "proj")
+
+	thread := threadName("Re: [PATCH 1/2] Add there")
+	for _, m := range []string{testPatch1, testPatch2} {
+		if err := saveMail(repoDir, thread, []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := saveMail(repoDir, threadName("[PATCH] Replace world"), []byte(testPatchConflict)); err != nil {
+		t.Fatal(err)
+	}
+
+	g := Gwi{config: Config{Root: root}}
+	threads := g.threads(repoDir)()
+	if len(threads) != 2 {
+		t.Fatalf("got %d threads", len(threads))
+	}
+
+	mails := g.mails(repo, repoDir)(thread)
+	if len(mails) != 2 {
+		t.Fatalf("got %d mails", len(mails))
+	}
+	if mails[1].Body != "The second one is attached." || len(mails[1].Attachments) != 1 {
+		t.Errorf("unexpected second mail %+v", mails[1])
+	}
+
+	var patches []*Patch
+	for _, m := range mails {
+		patches = append(patches, m.Patches...)
+	}
+	if len(patches) != 2 {
+		t.Fatalf("got %d patches", len(patches))
+	}
+	for _, p := range patches {
+		if p.Error != "" {
+			t.Errorf("patch %q: %s", p.Subject, p.Error)
+		}
+	}
+	if p := patches[1]; p.Subject != "Add main" || p.Message != "With a body." || p.Author != "Ann Dev" {
+		t.Errorf("unexpected patch %+v", p)
+	}
+
+	conflict := g.mails(repo, repoDir)("[PATCH] Replace world")
+	if len(conflict) != 1 || len(conflict[0].Patches) != 1 || conflict[0].Patches[0].Error == "" {
+		t.Errorf("conflicting patch was not detected")
+	}
+}
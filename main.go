@@ -15,15 +15,50 @@
 // Lastly, everything that comes after action is part of args, and it is passed
 // to templates under the Args field.
 //
+// Repositories can also be organized in groups, folders under the user that
+// are not repositories, as in /team/sub/project, the user owns all of them.
+// Group pages list their groups and repositories using repos.html. Since a
+// path could then name a group or an action, actions are separated from the
+// repository by /-/, as in /team/sub/project/-/tree, which is the form links
+// on templates should use. Without it the repository is the first folder of
+// the path that is one, so /user/repo/action keeps working. Names of users,
+// groups and repositories cannot be "-" or start with a dot.
+//
+// Repositories can be stored with or without the .git suffix, user/repo and
+// user/repo.git reach the same repository, which is shown without it.
+// Templates get the address to clone it on the CloneURL field, built with
+// [Config.Domain] if set.
+//
 // Some paths have special purposes and cannot be used by templates, they are:
 //
+//   - /search: searches all repositories, so search cannot be a user name
 //   - /user/repo/zip: for making archives
-//   - /user/repo/info/refs: this and the following are used by git
+//   - /user/repo/raw/path: serves the content of a file
+//   - /user/repo/info/refs: this and the following are used by git, which
+//     can use protocol version 0 or 2
 //   - /user/repo/git-receive-pack
 //   - /user/repo/git-upload-pack
+//   - /user/repo/HEAD and /user/repo/objects: for the dumb protocol, which
+//     also uses /user/repo/info/refs
+//   - /user/repo.git/info/lfs: the Git LFS API, see Git LFS below
+//   - /user/repo/admin/action: for managing repositories, see [Gwi.CreateRepo]
+//   - /user/repo/fork: forks the repo for the authenticated user
+//   - /user/repo/apply/thread: applies the patches of a thread, see
+//     [Gwi.ApplyThread]
+//   - /user/repo/subscribe and /user/repo/unsubscribe: manage notifications
 //
 // Creating template files with the names above will disable some features.
 //
+// Errors are shown using the error.html template, or 404.html for pages not
+// found if it exists, with an [ErrorInfo]. Details of internal errors are
+// only logged.
+//
+// gwi has a default theme, embedded from the templates folder of this
+// package, so [Config.PagesRoot] is optional. Templates found on PagesRoot
+// replace the default ones with the same name. Templates are parsed once,
+// when gwi starts. With [Config.DevMode] they are parsed again when the files
+// change, so edits show up without restarting.
+//
 // # User authentication
 //
 // gwi currently only supports HTTP Basic flow, authorization/authentication
@@ -31,6 +66,55 @@
 // project provides the [Vault] interface, which you should implement. Consult
 // the [FileVault] struct for an example.
 //
+// Repositories are public unless they have a file named private, which is
+// created by the private admin action, see [Gwi.SetPrivate]. Private
+// repositories can only be read by their owner, they are left out of
+// listings, search results and forks of other repositories, and their pages
+// are only cached by browsers. Forks only show and serve commits reachable
+// from their own references, not everything they borrow from their parent.
+//
+// # Git LFS
+//
+// gwi serves the Git LFS batch API with the basic transfer, and its locking
+// API, on /user/repo.git/info/lfs. Objects are stored on the lfs folder of
+// the repository, named by their OID. Downloads follow the read permission
+// of the repository, uploads and locks need the credentials of its owner.
+// The raw handler serves the content of pointer files whose object is
+// stored.
+//
+// # Webhooks
+//
+// After a successful push gwi posts a JSON payload to the webhooks listed on
+// the webhooks.json file of the repository, see [Webhook] for details.
+//
+// # Mirrors
+//
+// Repositories can mirror other repositories, in both directions, by using a
+// mirror.json file, see [Mirror] for details.
+//
+// # Mailing lists
+//
+// Every repository has a mailing list, messages are received by the SMTP
+// server started on [Config.MailAddress] and read on templates using the
+// threads and mails functions. Patches made with git format-patch are shown
+// as diffs. The owner of the repository can apply them to a branch by posting
+// to /user/repo/apply/thread, or by replying with the !apply command through
+// one of [Config.MailTrustedRelays].
+//
+// # Notifications
+//
+// When [Config.MailRelay] is set, users subscribed to a repository, see
+// [Gwi.Subscribe], get mail on pushes, with the commits and their diffstats,
+// and on messages sent to its mailing list. Mails are sent from
+// noreply@Domain to the address given by [User.Email].
+//
+// # Search
+//
+// Each repository can be searched on /user/repo/search using the search
+// function. When [Config.SearchIndex] is set, gwi also keeps a trigram index
+// of the default branch of every repository, updated after each push, and
+// /search looks for code across all of them, rendering global-search.html.
+//
 // # Template functions
 //
 // This package provides functions that you can call in your templates,
@@ -47,12 +131,19 @@
 //   - branches
 //   - tags
 //   - log
+//   - logsearch
 //   - commits
 //   - commit
+//   - lastcommit
+//   - readme
 //   - tree
 //   - files
 //   - file
 //   - markdown
+//   - mirrors
+//   - parent
+//   - forks
+//   - search
 //
 // Which can be called on templates using the standard template syntax.
 //
@@ -108,10 +199,16 @@ package gwi
 
 import (
 	"archive/zip"
+	"bytes"
+	"fmt"
 	"html/template"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"log/slog"
 
@@ -138,26 +235,52 @@ type File struct {
 }
 
 // Info is the structure that is passed as data to templates being executed.
-// The values are filled with the selected repo and user given on the URL.
+// The values are filled with the selected repo and user given on the URL,
+// Query has the query parameters of the request. Ref is the commit selected
+// by the ref parameter, which can be a hash, a branch or a tag, RefName is
+// that parameter, or the branch HEAD points to if it was not given.
 type Info struct {
-	User    string
-	Repo    string
-	Ref     plumbing.Hash
-	RefName string
-	Args    string
-	Git     *git.Repository
+	User     string
+	Repo     string
+	CloneURL string
+	Ref      plumbing.Hash
+	RefName  string
+	Args     string
+	Query    url.Values
+	Git      *git.Repository
 }
 
-// Config is used to configure the gwi application, things like Root and
-// PagesRoot are the central part that make gwi work. Domain, MailAddress and
-// Functions are mostly used to enhance the information displayed on templates.
+// Config is used to configure the gwi application, Root is the central part
+// that makes gwi work. PagesRoot holds templates that replace the ones of the
+// default theme. Domain, MailAddress and Functions are mostly used to enhance
+// the information displayed on templates. MirrorInterval is the time between
+// fetches of pull mirrors, if zero pull mirrors are not updated. SearchIndex
+// turns on the indexing of repositories used by the global search. DevMode
+// parses the templates again when files in PagesRoot change, useful while
+// writing them: if the parse fails the previous templates are kept and the
+// error is shown at the top of pages.
+//
+// If MailAddress is set gwi listens for SMTP on it, messages to
+// repo@Domain or user/repo@Domain go to the repository's mailing list.
+// MailMaxSize limits the size of messages, and MailAllowlist, if not empty,
+// lists the senders accepted, as addresses or domains like @example.com.
+// MailTrustedRelays lists the IP addresses or networks of the mail servers
+// trusted to verify senders, only messages coming from them can run !apply,
+// see [Command].
 type Config struct {
-	Domain      string
-	MailAddress string
-	PagesRoot   string
-	Root        string
-	LogLevel    slog.Level
-	Functions   map[string]func(p ...any) any
+	Domain            string
+	MailAddress       string
+	MailMaxSize       int64
+	MailAllowlist     []string
+	MailTrustedRelays []string
+	MailRelay         string
+	PagesRoot         string
+	Root              string
+	LogLevel          slog.Level
+	Functions         map[string]func(p ...any) any
+	MirrorInterval    time.Duration
+	SearchIndex       bool
+	DevMode           bool
 }
 
 // Vault is used to authenticate write calls to git repositories, the Vault
@@ -173,8 +296,8 @@ type Vault interface {
 // git requests
 type Gwi struct {
 	config    Config
-	pages     *template.Template
-	handler   *mux.Router
+	pages     *pageSet
+	handler   http.Handler
 	vault     Vault
 	functions map[string]func(params ...any) any
 }
@@ -184,23 +307,30 @@ var p = bluemonday.UGCPolicy()
 // FuncMapTempl gives the signatures for all functions available on templates.
 var FuncMapTempl = map[string]any{
 	// "sysinfo":  sysInfo,
-	"usage":    diskUsage,
-	"users":    func() []string { return nil },
-	"repos":    func(user string) []string { return nil },
-	"head":     func() *plumbing.Reference { return nil },
-	"threads":  func(section string) []any { return nil },
-	"mails":    func(thread string) []any { return nil },
-	"desc":     func(ref plumbing.Hash) string { return "" },
-	"branches": func(ref plumbing.Hash) []*plumbing.Reference { return nil },
-	"tags":     func() []*plumbing.Reference { return nil },
-	"log":      func(ref plumbing.Hash) []*object.Commit { return nil },
-	"commits":  func(ref plumbing.Hash) int { return -1 },
-	"commit":   func(ref plumbing.Hash) *object.Commit { return nil },
-	"tree":     func(ref plumbing.Hash) []File { return nil },
-	"files":    func(ref plumbing.Hash) int { return -1 },
-	"file":     func(ref plumbing.Hash, name string) string { return "" },
-	"markdown": mdown,
-	"wrap":     wrap,
+	"usage":      diskUsage,
+	"users":      func() []string { return nil },
+	"repos":      func(user string) []string { return nil },
+	"head":       func() *plumbing.Reference { return nil },
+	"threads":    func(filters ...string) []Thread { return nil },
+	"mails":      func(thread string) []Mail { return nil },
+	"desc":       func(ref plumbing.Hash) string { return "" },
+	"branches":   func(ref plumbing.Hash) []*plumbing.Reference { return nil },
+	"tags":       func() []*plumbing.Reference { return nil },
+	"log":        func(ref plumbing.Hash) []*object.Commit { return nil },
+	"logsearch":  func(ref plumbing.Hash, query url.Values) LogSearchResult { return LogSearchResult{} },
+	"commits":    func(ref plumbing.Hash) int { return -1 },
+	"commit":     func(ref plumbing.Hash) *object.Commit { return nil },
+	"lastcommit": func(ref plumbing.Hash, path string) *object.Commit { return nil },
+	"readme":     func(ref plumbing.Hash) template.HTML { return "" },
+	"tree":       func(ref plumbing.Hash) []File { return nil },
+	"files":      func(ref plumbing.Hash) int { return -1 },
+	"file":       func(ref plumbing.Hash, name string) string { return "" },
+	"markdown":   mdown,
+	"wrap":       wrap,
+	"mirrors":    func() []MirrorStatus { return nil },
+	"parent":     func() string { return "" },
+	"forks":      func() []string { return nil },
+	"search":     func(ref plumbing.Hash, query url.Values) SearchResult { return SearchResult{} },
 }
 
 func NewFromConfig(cfg Config, vault Vault) (Gwi, error) {
@@ -222,40 +352,88 @@ func NewFromConfig(cfg Config, vault Vault) (Gwi, error) {
 	for name, f := range FuncMapTempl {
 		funcMap[name] = f
 	}
+	funcMap["users"] = gwi.users
+	funcMap["repos"] = gwi.repos
 	for name, f := range cfg.Functions {
 		funcMap[name] = f
 	}
-	gwi.pages = template.New("all").Funcs(funcMap).Option()
-
-	// mail
-	var err error
-	if err != nil {
-		slog.Error("new mailer", "error", err.Error())
-	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/{user}/{repo}/info/refs", gwi.infoRefsHandler).
-		Queries("service", "{service}")
-	r.HandleFunc("/{user}/{repo}/git-receive-pack", gwi.receivePackHandler)
-	r.HandleFunc("/{user}/{repo}/git-upload-pack", gwi.uploadPackHandler)
-	r.HandleFunc("/{user}/{repo}/HEAD", gwi.headHandler)
-	r.HandleFunc("/{user}/{repo}/objects/{pre:.{2}}/{obj:.+}", gwi.objHandler)
-	r.HandleFunc("/{user}/{repo}/objects/{obj:.+}", gwi.fileHandler)
-
 	r.HandleFunc("/", gwi.ListHandler)
-	r.HandleFunc("/{user}", gwi.ListHandler)
-	r.HandleFunc("/{user}/{repo}/zip", gwi.zipHandler)
-	r.HandleFunc("/{user}/{repo}/{op}/{args:.*}", gwi.MainHandler)
-	r.HandleFunc("/{user}/{repo}/{op}/{args:.*}", gwi.MainHandler)
-	r.HandleFunc("/{user}/{repo}/{op}", gwi.MainHandler)
-	r.HandleFunc("/{user}/{repo}/", gwi.MainHandler)
-	r.HandleFunc("/{user}/{repo}", gwi.MainHandler)
+	r.HandleFunc("/search", gwi.SearchHandler)
+
+	// paths of repositories are rewritten to this form by canonicalRepo,
+	// user holds the groups of the repository
+	const repo = "/{user:.+?}/{repo}/-"
+	r.HandleFunc(repo+"/info/refs", gwi.infoRefsHandler).
+		Queries("service", "{service}")
+	r.HandleFunc(repo+"/git-receive-pack", gwi.receivePackHandler)
+	r.HandleFunc(repo+"/git-upload-pack", gwi.uploadPackHandler)
+	r.HandleFunc(repo+"/info/refs", gwi.dumbRefsHandler)
+	r.HandleFunc(repo+"/HEAD", gwi.headHandler)
+	r.HandleFunc(repo+"/objects/info/packs", gwi.packsHandler)
+	r.HandleFunc(repo+"/objects/info/http-alternates", gwi.httpAlternatesHandler)
+	r.HandleFunc(repo+"/objects/{pre:[0-9a-f]{2}}/{obj:[0-9a-f]{38}}", gwi.objHandler)
+	r.HandleFunc(repo+"/objects/pack/{pack:pack-[0-9a-f]{40}\\.(?:pack|idx)}", gwi.packHandler)
+	r.HandleFunc(repo+"/objects/{path:.*}", http.NotFound)
+	r.HandleFunc(repo+"/info/lfs/objects/batch", gwi.lfsBatchHandler).
+		Methods(http.MethodPost)
+	r.HandleFunc(repo+"/info/lfs/objects/{oid:[0-9a-f]{64}}", gwi.lfsObjectHandler).
+		Methods(http.MethodGet, http.MethodPut)
+	r.HandleFunc(repo+"/info/lfs/verify", gwi.lfsVerifyHandler).
+		Methods(http.MethodPost)
+	r.HandleFunc(repo+"/info/lfs/locks", gwi.lfsLocksHandler).
+		Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc(repo+"/info/lfs/locks/verify", gwi.lfsVerifyLocksHandler).
+		Methods(http.MethodPost)
+	r.HandleFunc(repo+"/info/lfs/locks/{id}/unlock", gwi.lfsUnlockHandler).
+		Methods(http.MethodPost)
+
+	r.HandleFunc(repo+"/zip", gwi.zipHandler)
+	r.HandleFunc(repo+"/raw/{path:.+}", gwi.rawHandler)
+	r.HandleFunc(repo+"/admin/{action}", gwi.adminHandler).
+		Methods(http.MethodPost)
+	r.HandleFunc(repo+"/fork", gwi.forkHandler).
+		Methods(http.MethodPost)
+	r.HandleFunc(repo+"/apply/{thread}", gwi.applyHandler).
+		Methods(http.MethodPost)
+	r.HandleFunc(repo+"/{op:subscribe|unsubscribe}", gwi.subscribeHandler).
+		Methods(http.MethodPost)
+	r.HandleFunc(repo+"/{op}/{args:.*}", gwi.MainHandler)
+	r.HandleFunc(repo+"/{op}", gwi.MainHandler)
+	r.HandleFunc(repo+"/", gwi.MainHandler)
+	r.HandleFunc(repo, gwi.MainHandler)
+
+	// users and groups
+	r.HandleFunc("/{user:.+}", gwi.ListHandler)
+
+	r.Use(compress)
+	gwi.handler = gwi.canonicalRepo(r)
+
+	if cfg.MirrorInterval > 0 {
+		go gwi.pullMirrors(cfg.MirrorInterval)
+	}
+	if cfg.SearchIndex {
+		go gwi.indexRepos()
+	}
 
-	gwi.handler = r
+	// mail
+	if cfg.MailAddress != "" {
+		l, err := net.Listen("tcp", cfg.MailAddress)
+		if err != nil {
+			return gwi, err
+		}
+		go func() {
+			if err := gwi.serveMail(l); err != nil {
+				slog.Error("serve mail", "error", err.Error())
+			}
+		}()
+	}
 
 	// read templates
 	slog.Debug("parsing templates...")
-	gwi.pages, err = gwi.pages.ParseGlob(path.Join(cfg.PagesRoot, "*.html"))
+	var err error
+	gwi.pages, err = newPageSet(cfg.PagesRoot, funcMap, cfg.DevMode)
 
 	return gwi, err
 }
@@ -266,11 +444,81 @@ func (g *Gwi) Handle() http.Handler {
 	return g.handler
 }
 
-// ListHandler is used for listing users, or repos for a user given in the URL
-// path, this handler is useful for creating listings of projects, as this is
-// very light on reads, and can be executed more often. It populates the
-// template data with just User and Repo fields, along with 2 functions: users
-// and repos.
+// canonicalRepo rewrites the paths of repositories to the form the routes
+// use, see [Gwi.repoRoute]. Other paths are left as they are, those with
+// hidden folders are not found.
+func (g *Gwi) canonicalRepo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := g.repoRoute(r.URL.Path)
+		if !ok {
+			for _, name := range strings.Split(r.URL.Path, "/") {
+				if name == "-" {
+					break
+				}
+				if strings.HasPrefix(name, ".") {
+					http.NotFound(w, r)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if route == r.URL.Path {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = route
+		r2.URL.RawPath = ""
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// createActions are the actions that can create repositories.
+var createActions = []string{"info/refs", "git-receive-pack", "admin/create"}
+
+// repoRoute finds the repository of a path and returns the path in the form
+// /user/groups/repo/-/action. The repository is the first folder of the path
+// that is one, named with or without the .git suffix, and the separator is
+// optional on requests. Paths of missing repositories are only rewritten for
+// createActions.
+func (g *Gwi) repoRoute(urlPath string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(urlPath, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		if !validName(parts[i-1]) || !validName(parts[i]) {
+			return "", false
+		}
+		namespace := strings.Join(parts[:i], "/")
+		name := repoName(g.config.Root, namespace, parts[i])
+		rest := parts[i+1:]
+		if !isRepo(path.Join(g.config.Root, namespace, name)) {
+			action := strings.Join(rest, "/")
+			if !contains(createActions, strings.TrimPrefix(action, "-/")) {
+				continue
+			}
+		}
+
+		if len(rest) > 0 && rest[0] == "-" {
+			rest = rest[1:]
+		}
+		route := "/" + namespace + "/" + name + "/-"
+		if len(rest) > 0 {
+			route += "/" + strings.Join(rest, "/")
+		}
+		return route, true
+	}
+	return "", false
+}
+
+// ListHandler is used for listing users, or repos and groups of a user or
+// group given in the URL path, this handler is useful for creating listings
+// of projects, as this is very light on reads, and can be executed more
+// often. It populates the template data with the User, Users, Groups and
+// Repos fields, along with 2 functions: users and repos.
 func (g *Gwi) ListHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	slog.Debug("running list handler with", "vars", vars)
@@ -278,8 +526,10 @@ func (g *Gwi) ListHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 
 	info := struct {
-		Users []string
-		Repos []Info
+		User   string
+		Users  []string
+		Groups []string
+		Repos  []Info
 	}{}
 
 	page := "users.html"
@@ -291,7 +541,7 @@ func (g *Gwi) ListHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		for _, d := range dir {
-			if !d.IsDir() {
+			if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
 				continue
 			}
 
@@ -300,111 +550,221 @@ func (g *Gwi) ListHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		slog.Debug("getting repos", "user", user)
 		page = "repos.html"
+		info.User = user
 
 		root := path.Join(g.config.Root, user)
 		dir, err := os.ReadDir(root)
 		if err != nil {
 			slog.Debug("readDir", "error", err.Error())
 		}
+		if err != nil && (strings.Contains(user, "/") || g.vault == nil || g.vault.GetUser(user) == nil) {
+			g.httpError(w, r, ErrNotFound)
+			return
+		}
 
 		for _, d := range dir {
-			if !d.IsDir() {
+			if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+				continue
+			}
+			if !isRepo(path.Join(root, d.Name())) {
+				info.Groups = append(info.Groups, user+"/"+d.Name())
+				continue
+			}
+			if !g.canRead(r, user, d.Name()) {
 				continue
 			}
 
-			repo, err := git.PlainOpen(path.Join(root, d.Name()))
+			repo, err := repos.open(path.Join(root, d.Name()))
 			if err != nil {
 				slog.Debug("open repo", "error", err.Error())
 				continue
 			}
-			info.Repos = append(info.Repos, Info{Repo: d.Name(), Git: repo})
+			defer repo.close()
+			info.Repos = append(info.Repos, Info{
+				User:     user,
+				Repo:     displayName(d.Name()),
+				CloneURL: g.cloneURL(r, user, d.Name()),
+				Git:      repo.Repository,
+			})
 		}
 	}
 
-	if err := g.pages.ExecuteTemplate(w, page, info); err != nil {
-		slog.Error("execute", "error", err.Error())
+	pages, err := g.pages.get()
+	if err != nil {
+		g.httpError(w, r, err)
+		return
 	}
+	buf := bytes.Buffer{}
+	if err := pages.ExecuteTemplate(&buf, page, info); err != nil {
+		g.httpError(w, r, fmt.Errorf("execute %s: %w", page, err))
+		return
+	}
+	w.Write(withParseError(buf.Bytes(), g.pages.parseError()))
 }
 
 // MainHandler is the handler used to display information about a repository.
 // It contains all functions defined it [FuncMapTempl] with the correct user
 // and repo selected; and provides the complete Info struct as data to the
 // template. This handler is used to display data like commits, files, branches
-// and tags about a given repo.
+// and tags about a given repo. The summary of empty repositories uses
+// empty.html.
 func (g *Gwi) MainHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	slog.Debug("running main handler", "vars", vars)
 
+	if !g.readable(w, r, vars["user"], vars["repo"]) {
+		return
+	}
+
 	info := Info{
-		User: vars["user"],
-		Repo: vars["repo"],
-		Ref:  plumbing.NewHash(r.URL.Query().Get("ref")),
-		Args: vars["args"],
+		User:     vars["user"],
+		Repo:     displayName(vars["repo"]),
+		CloneURL: g.cloneURL(r, vars["user"], vars["repo"]),
+		RefName:  r.URL.Query().Get("ref"),
+		Args:     vars["args"],
+		Query:    r.URL.Query(),
 	}
-	repoDir := path.Join(g.config.Root, info.User, info.Repo)
+	repoDir := path.Join(g.config.Root, info.User, vars["repo"])
 
-	var err error
-	info.Git, err = git.PlainOpen(repoDir)
+	repo, err := repos.open(repoDir)
 	if err != nil {
-		slog.Error("git PlainOpen", "error", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		g.httpError(w, r, err)
 		return
 	}
+	defer repo.close()
+	info.Git = repo.Repository
+	if info.RefName == plumbing.ZeroHash.String() {
+		// links of empty repositories
+		info.RefName = ""
+	}
 
-	funcMap := map[string]any{
+	commit, immutable, err := resolveOwnRef(repo, info.RefName)
+	switch {
+	case err == nil:
+		info.Ref = commit.Hash
+		if info.RefName == "" {
+			head, _ := info.Git.Head()
+			info.RefName = head.Name().Short()
+		}
+	case info.RefName != "":
+		g.httpError(w, r, ErrBadRef)
+		return
+	default:
+		// empty repository, there is no commit to show
 	}
-	pages := g.pages.Funcs(funcMap)
 
 	op := vars["op"]
 	if op == "" {
 		op = "summary"
 	}
+	if op == "summary" && info.Ref.IsZero() {
+		op = "empty"
+	}
+	// other pages show branches, threads and forks, which change, and in
+	// development mode templates change too
+	immutable = immutable && immutableOps[op] && !g.config.DevMode
+	modified := time.Time{}
+	if immutable {
+		modified = commit.Committer.When
+	}
+	private := isPrivate(repoDir)
+	pages, err := g.pages.get()
+	if err != nil {
+		g.httpError(w, r, err)
+		return
+	}
+	if pages.Lookup(op+".html") == nil {
+		g.httpError(w, r, ErrNotFound)
+		return
+	}
+
+	// pages addressed by hash only change if the request changes
+	tag := ""
+	if immutable {
+		tag = etag(op, info.Args, r.URL.RawQuery, info.Ref.String())
+		if cacheHeaders(w, r, tag, modified, true, private) {
+			return
+		}
+	}
+
+	funcMap := map[string]any{
+		"head":       g.head(info.Git),
+		"desc":       g.desc(info.Git),
+		"branches":   g.branches(info.Git),
+		"tags":       g.tags(info.Git),
+		"commit":     g.commit(info.Git),
+		"tree":       g.tree(info.Git),
+		"file":       g.file(info.Git),
+		"mirrors":    g.mirrors(repoDir),
+		"parent":     g.parent(repoDir),
+		"forks":      g.forks(info.User, vars["repo"]),
+		"threads":    g.threads(repoDir),
+		"mails":      g.mails(info.Git, repoDir),
+		"search":     g.search(info.Git),
+		"log":        g.log(info.Git),
+		"logsearch":  g.logsearch(info.Git),
+		"files":      g.files(repo),
+		"commits":    g.commits(repo),
+		"readme":     g.readme(repo),
+		"lastcommit": g.lastcommit(repo),
+	}
+	pages = pages.Funcs(funcMap)
+
+	buf := bytes.Buffer{}
+	if err := pages.ExecuteTemplate(&buf, op+".html", info); err != nil {
+		g.httpError(w, r, fmt.Errorf("execute %s: %w", op, err))
+		return
+	}
+	page := withParseError(buf.Bytes(), g.pages.parseError())
 
 	w.Header().Set("Content-Type", "text/html")
-	if err := pages.ExecuteTemplate(w, op+".html", info); err != nil {
-		slog.Error("execute", "error", err.Error())
+	if !immutable {
+		tag = etag(string(page))
+		if cacheHeaders(w, r, tag, modified, false, private) {
+			return
+		}
 	}
+	w.Write(page)
 }
 
+// immutableOps are the pages that only show the content of a commit, so they
+// never change when it is addressed by hash.
+var immutableOps = map[string]bool{"tree": true, "files": true, "commit": true}
+
 func (g *Gwi) zipHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	slog.Debug("running zip handler", "vars", vars)
 
+	if !g.readable(w, r, vars["user"], vars["repo"]) {
+		return
+	}
+
 	info := Info{
 		User: vars["user"],
 		Repo: vars["repo"],
-		Ref:  plumbing.NewHash(r.URL.Query().Get("ref")),
 	}
 	repoDir := path.Join(g.config.Root, info.User, info.Repo)
 
-	repo, err := git.PlainOpen(repoDir)
+	repo, err := repos.open(repoDir)
 	if err != nil {
-		slog.Error("git PlainOpen", "error", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		g.httpError(w, r, err)
 		return
 	}
+	defer repo.close()
 
-	if r.URL.Query().Get("ref") == "" {
-		head, err := repo.Head()
-		if err != nil {
-			slog.Error("git head", "error", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		info.Ref = head.Hash()
-	}
-	commit, err := repo.CommitObject(info.Ref)
+	commit, immutable, err := resolveOwnRef(repo, r.URL.Query().Get("ref"))
 	if err != nil {
-		slog.Error("commit", "error", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		g.httpError(w, r, ErrBadRef)
+		return
+	}
+	if cacheHeaders(w, r, etag("zip", commit.Hash.String()), commit.Committer.When, immutable, isPrivate(repoDir)) {
 		return
 	}
 
 	slog.Debug("getting tree for commit", "hash", commit.Hash.String())
 	tree, err := commit.Tree()
 	if err != nil {
-		slog.Error("trees", "error", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		g.httpError(w, r, err)
 		return
 	}
 
@@ -415,7 +775,6 @@ func (g *Gwi) zipHandler(w http.ResponseWriter, r *http.Request) {
 		z, err := arc.Create(f.Name)
 		if err != nil {
 			slog.Error("create file", "error", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return err
 		}
 
@@ -436,6 +795,5 @@ func (g *Gwi) zipHandler(w http.ResponseWriter, r *http.Request) {
 	err = arc.Close()
 	if err != nil {
 		slog.Error("close file", "error", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -2,10 +2,21 @@ package gwi
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 func Test_main(t *testing.T) {
@@ -33,3 +44,236 @@ func Test_main(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func Test_Namespaces(t *testing.T) {
+	root := t.TempDir()
+	testCommit(t, testRepo(t, root, "x", "app"), map[string]string{"README.md": "app\n"}, "init")
+	proj := testRepo(t, root, "x/sub", "proj")
+	head := testCommit(t, proj, map[string]string{"README.md": "proj\n"}, "init")
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates", Domain: "git.example.com"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(url string, code int) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != code {
+			t.Errorf("%s: %d, want %d", url, rec.Code, code)
+		}
+		return rec.Body.String()
+	}
+
+	if body := get("/x", http.StatusOK); !strings.Contains(body, `href="/x/sub"`) || !strings.Contains(body, `href="/x/app"`) {
+		t.Errorf("user page:\n%s", body)
+	}
+	if body := get("/x/sub", http.StatusOK); !strings.Contains(body, `href="/x/sub/proj"`) {
+		t.Errorf("group page:\n%s", body)
+	}
+	for _, url := range []string{"/x/sub/proj/-/empty", "/x/sub/proj/empty", "/x/sub/proj.git/-/empty"} {
+		body := get(url, http.StatusOK)
+		if !strings.Contains(body, "<h1>proj</h1>") || !strings.Contains(body, "git clone http://git.example.com/x/sub/proj<") {
+			t.Errorf("%s:\n%s", url, body)
+		}
+	}
+	if body := get("/x/sub/proj/-/raw/README.md", http.StatusOK); body != "proj\n" {
+		t.Errorf("raw: %q", body)
+	}
+	get("/x/nope", http.StatusNotFound)
+	get("/x/sub/nope/tree", http.StatusNotFound)
+	get("/.trash/x", http.StatusNotFound)
+
+	var found []string
+	eachRepo(root, func(user, repo string) { found = append(found, user+"/"+repo) })
+	sort.Strings(found)
+	if strings.Join(found, " ") != "x/app x/sub/proj" {
+		t.Errorf("eachRepo: %v", found)
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		return
+	}
+	srv := httptest.NewServer(g.Handle())
+	defer srv.Close()
+	work := t.TempDir()
+	testGit(t, work, "clone", srv.URL+"/x/sub/proj", "proj")
+	clone := path.Join(work, "proj")
+	if out := strings.TrimSpace(testGit(t, clone, "rev-parse", "HEAD")); out != head.String() {
+		t.Errorf("clone: %s, want %s", out, head)
+	}
+
+	// pushes create repositories in groups of their owner only
+	cmd := exec.Command("git", "push", strings.Replace(srv.URL, "://", "://y:1234@", 1)+"/x/sub/new", "main")
+	cmd.Dir = clone
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("push by another user:\n%s", out)
+	}
+	testGit(t, clone, "push", strings.Replace(srv.URL, "://", "://x:1234@", 1)+"/x/sub/new", "main")
+	if !isRepo(path.Join(root, "x", "sub", "new")) {
+		t.Error("push did not create x/sub/new")
+	}
+}
+
+// testRepo creates a bare repository at root/user/repo.
+func testRepo(t *testing.T, root, user, repo string) *git.Repository {
+	t.Helper()
+
+	dir := path.Join(root, user, repo)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	r, err := git.PlainInit(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName("main"))
+	if err := r.Storer.SetReference(h); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func Test_GitSuffix(t *testing.T) {
+	root := t.TempDir()
+	testCommit(t, testRepo(t, root, "x", "proj"), map[string]string{"README.md": "proj\n"}, "init")
+	testCommit(t, testRepo(t, root, "x", "old.git"), map[string]string{"README.md": "old\n"}, "init")
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates", Domain: "git.example.com"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(url string) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: %d %s", url, rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+
+	for url, name := range map[string]string{
+		"/x/proj/empty":     "proj",
+		"/x/proj.git/empty": "proj",
+		"/x/old/empty":      "old",
+		"/x/old.git/empty":  "old",
+	} {
+		body := get(url)
+		if !strings.Contains(body, "<h1>"+name+"</h1>") || !strings.Contains(body, "git clone http://git.example.com/x/"+name+"<") {
+			t.Errorf("%s:\n%s", url, body)
+		}
+	}
+	if body := get("/x/old.git/raw/README.md"); body != "old\n" {
+		t.Errorf("raw: %q", body)
+	}
+	if body := get("/x"); strings.Contains(body, "old.git") {
+		t.Errorf("suffix in list:\n%s", body)
+	}
+
+	if err := g.CreateRepo("x", "new.git", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(root, "x", "new")); err != nil {
+		t.Errorf("new.git not created as new: %v", err)
+	}
+	if err := g.CreateRepo("x", "old", ""); err != ErrRepoExists {
+		t.Errorf("old created over old.git: %v", err)
+	}
+}
+
+// testCommit writes a commit on the main branch whose tree holds exactly
+// files, a map of paths to contents, and returns its hash.
+func testCommit(t *testing.T, repo *git.Repository, files map[string]string, msg string) plumbing.Hash {
+	t.Helper()
+
+	tree, err := testTree(repo, "", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := object.Signature{Name: "tester", Email: "tester@localhost", When: time.Now()}
+	commit := &object.Commit{
+		Author:    sig,
+		Committer: sig,
+		Message:   msg,
+		TreeHash:  tree,
+	}
+	branch := plumbing.NewBranchReferenceName("main")
+	if head, err := repo.Reference(branch, true); err == nil {
+		commit.ParentHashes = []plumbing.Hash{head.Hash()}
+	}
+
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, hash)); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func testTree(repo *git.Repository, dir string, files map[string]string) (plumbing.Hash, error) {
+	tree := &object.Tree{}
+	subdirs := map[string]bool{}
+	for name, content := range files {
+		if !strings.HasPrefix(name, dir) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, dir)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			subdirs[rest[:i]] = true
+			continue
+		}
+
+		obj := repo.Storer.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+		w, _ := obj.Writer()
+		w.Write([]byte(content))
+		w.Close()
+		hash, err := repo.Storer.SetEncodedObject(obj)
+		if err != nil {
+			return hash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: rest, Mode: filemode.Regular, Hash: hash})
+	}
+	for sub := range subdirs {
+		hash, err := testTree(repo, dir+sub+"/", files)
+		if err != nil {
+			return hash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: sub, Mode: filemode.Dir, Hash: hash})
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return treeEntryName(tree.Entries[i]) < treeEntryName(tree.Entries[j])
+	})
+
+	obj := repo.Storer.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+// treeEntryName gives the name git uses to sort tree entries, directories
+// are compared as if they had a trailing slash.
+func treeEntryName(e object.TreeEntry) string {
+	if e.Mode == filemode.Dir {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+// testVault returns a vault with the users x and y, both with password 1234.
+func testVault() FileVault {
+	v := FileVault{salt: "--salt--", Users: map[string]User{}}
+	for _, name := range []string{"x", "y"} {
+		v.Users[name] = vaultUser{Name: name, Address: name + "@localhost", Password: v.mix("1234")}
+	}
+	return v
+}
@@ -0,0 +1,249 @@
+package gwi
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+// Mirror configures a repository as a mirror of other repositories, it is
+// read from the mirror.json file inside the bare repository. Pull is the URL
+// of an upstream repository that is fetched every [Config.MirrorInterval],
+// and Push lists remotes that receive all branches and tags after every push
+// to this repository.
+type Mirror struct {
+	Pull string
+	Push []string
+}
+
+// MirrorStatus is the result of the last synchronization with a remote,
+// Direction is either pull or push. Error is empty if the sync succeeded.
+type MirrorStatus struct {
+	URL       string
+	Direction string
+	Time      time.Time
+	Error     string
+}
+
+const (
+	mirrorFile   = "mirror.json"
+	mirrorStatus = "mirror-status.json"
+)
+
+var (
+	mirrorRefSpecs = []config.RefSpec{
+		"+refs/heads/*:refs/heads/*",
+		"+refs/tags/*:refs/tags/*",
+	}
+
+	mirrorMu sync.Mutex
+)
+
+func readMirror(repoDir string) (Mirror, error) {
+	m := Mirror{}
+	data, err := os.ReadFile(path.Join(repoDir, mirrorFile))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// pullMirrors fetches all pull mirrors under Root, then repeats it every
+// interval.
+func (g *Gwi) pullMirrors(interval time.Duration) {
+	for {
+		eachRepo(g.config.Root, g.pullMirror)
+		time.Sleep(interval)
+	}
+}
+
+// pullMirror fetches branches and tags from the upstream of the repository,
+// if it is configured as a pull mirror. Changed references are handled like
+// a push, see [Gwi.refsUpdated].
+func (g *Gwi) pullMirror(user, repo string) {
+	repoDir := path.Join(g.config.Root, user, repo)
+	m, err := readMirror(repoDir)
+	if err != nil {
+		slog.Error("read mirror", "error", err.Error())
+		return
+	}
+	if m.Pull == "" {
+		return
+	}
+
+	slog.Debug("pulling mirror", "repo", repoDir, "url", m.Pull)
+	status := MirrorStatus{URL: m.Pull, Direction: "pull", Time: time.Now()}
+	before := mirrorRefs(repoDir)
+	err = syncRemote(repoDir, m.Pull, func(remote *git.Remote) error {
+		return remote.Fetch(&git.FetchOptions{
+			RemoteName: "mirror",
+			RefSpecs:   mirrorRefSpecs,
+			Force:      true,
+		})
+	})
+	if err != nil {
+		slog.Error("pull mirror", "url", m.Pull, "error", err.Error())
+		status.Error = err.Error()
+	}
+	saveMirrorStatus(repoDir, status)
+
+	// a failed fetch may still have updated some references
+	after := mirrorRefs(repoDir)
+	var cmds []*packp.Command
+	for name, hash := range after {
+		if before[name] != hash {
+			cmds = append(cmds, &packp.Command{Name: name, Old: before[name], New: hash})
+		}
+	}
+	for name, hash := range before {
+		if _, ok := after[name]; !ok {
+			cmds = append(cmds, &packp.Command{Name: name, Old: hash, New: plumbing.ZeroHash})
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	g.refsUpdated(user, repo, cmds)
+}
+
+// mirrorRefs returns the branches and tags of the repository.
+func mirrorRefs(repoDir string) map[plumbing.ReferenceName]plumbing.Hash {
+	refs := map[plumbing.ReferenceName]plumbing.Hash{}
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		slog.Error("git PlainOpen", "error", err.Error())
+		return refs
+	}
+	iter, err := repo.References()
+	if err != nil {
+		slog.Error("references", "error", err.Error())
+		return refs
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && (ref.Name().IsBranch() || ref.Name().IsTag()) {
+			refs[ref.Name()] = ref.Hash()
+		}
+		return nil
+	})
+	return refs
+}
+
+// pushMirrors pushes branches and tags of the repository to all its push
+// mirrors, references deleted here are also deleted on the remotes.
+func (g *Gwi) pushMirrors(user, repo string) {
+	repoDir := path.Join(g.config.Root, user, repo)
+	m, err := readMirror(repoDir)
+	if err != nil {
+		slog.Error("read mirror", "error", err.Error())
+		return
+	}
+
+	for _, url := range m.Push {
+		slog.Debug("pushing mirror", "repo", repoDir, "url", url)
+		status := MirrorStatus{URL: url, Direction: "push", Time: time.Now()}
+		err := syncRemote(repoDir, url, func(remote *git.Remote) error {
+			return remote.Push(&git.PushOptions{
+				RemoteName: "mirror",
+				RefSpecs:   mirrorRefSpecs,
+				Force:      true,
+				Prune:      true,
+			})
+		})
+		if err != nil {
+			slog.Error("push mirror", "url", url, "error", err.Error())
+			status.Error = err.Error()
+		}
+		saveMirrorStatus(repoDir, status)
+	}
+}
+
+func syncRemote(repoDir, url string, f func(remote *git.Remote) error) error {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return err
+	}
+
+	remote := git.NewRemote(
+		repo.Storer,
+		&config.RemoteConfig{Name: "mirror", URLs: []string{url}},
+	)
+	err = f(remote)
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+func readMirrorStatus(repoDir string) (map[string]MirrorStatus, error) {
+	statuses := map[string]MirrorStatus{}
+	data, err := os.ReadFile(path.Join(repoDir, mirrorStatus))
+	if os.IsNotExist(err) {
+		return statuses, nil
+	}
+	if err != nil {
+		return statuses, err
+	}
+
+	err = json.Unmarshal(data, &statuses)
+	return statuses, err
+}
+
+func saveMirrorStatus(repoDir string, status MirrorStatus) {
+	mirrorMu.Lock()
+	defer mirrorMu.Unlock()
+
+	statuses, err := readMirrorStatus(repoDir)
+	if err != nil {
+		slog.Error("read mirror status", "error", err.Error())
+	}
+	statuses[status.Direction+" "+status.URL] = status
+
+	data, err := json.Marshal(statuses)
+	if err != nil {
+		slog.Error("marshal mirror status", "error", err.Error())
+		return
+	}
+	if err := os.WriteFile(path.Join(repoDir, mirrorStatus), data, 0o600); err != nil {
+		slog.Error("write mirror status", "error", err.Error())
+	}
+}
+
+// mirrors returns the status of the last sync with each remote of the
+// repository, pull mirrors come first.
+func (g *Gwi) mirrors(repoDir string) func() []MirrorStatus {
+	return func() []MirrorStatus {
+		slog.Debug("getting mirrors", "repo", repoDir)
+		mirrorMu.Lock()
+		statuses, err := readMirrorStatus(repoDir)
+		mirrorMu.Unlock()
+		if err != nil {
+			slog.Error("read mirror status", "error", err.Error())
+			return nil
+		}
+
+		var list []MirrorStatus
+		for _, s := range statuses {
+			list = append(list, s)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Direction != list[j].Direction {
+				return list[i].Direction == "pull"
+			}
+			return list[i].URL < list[j].URL
+		})
+		return list
+	}
+}
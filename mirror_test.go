@@ -0,0 +1,83 @@
+package gwi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func Test_Mirrors(t *testing.T) {
+	root := t.TempDir()
+	remotes := t.TempDir()
+
+	upstream := testRepo(t, remotes, "up", "proj")
+	hash := testCommit(t, upstream, map[string]string{"main.go": "package main"}, "init")
+	backup := testRepo(t, remotes, "backup", "proj")
+	testRepo(t, root, "x", "proj")
+
+	m := Mirror{
+		Pull: "file://" + path.Join(remotes, "up", "proj"),
+		Push: []string{"file://" + path.Join(remotes, "backup", "proj")},
+	}
+	data, _ := json.Marshal(m)
+	repoDir := path.Join(root, "x", "proj")
+	if err := os.WriteFile(path.Join(repoDir, mirrorFile), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// pulled references are handled like a push
+	pushes := make(chan WebhookPayload, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pay WebhookPayload
+		json.NewDecoder(r.Body).Decode(&pay)
+		pushes <- pay
+	}))
+	defer srv.Close()
+	data, _ = json.Marshal([]Webhook{{URL: srv.URL, Events: []string{"push"}}})
+	if err := os.WriteFile(path.Join(repoDir, webhooksFile), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	g := Gwi{config: Config{Root: root}}
+	g.pullMirror("x", "proj")
+	select {
+	case pay := <-pushes:
+		if len(pay.Refs) != 1 || len(pay.Commits) != 1 || pay.Commits[0].Hash != hash.String() {
+			t.Errorf("unexpected payload %+v", pay)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+
+	// push mirrors are updated in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ref, err := backup.Reference(plumbing.NewBranchReferenceName("main"), true)
+		if err == nil && ref.Hash() == hash {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backup main is %v, want %s", ref, hash)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, s := range g.mirrors(repoDir)() {
+		if s.Error != "" {
+			t.Errorf("%s %s: %s", s.Direction, s.URL, s.Error)
+		}
+	}
+
+	// nothing changed upstream
+	g.pullMirror("x", "proj")
+	select {
+	case pay := <-pushes:
+		t.Errorf("webhook sent without changes %+v", pay)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
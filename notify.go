@@ -0,0 +1,367 @@
+package gwi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/gorilla/mux"
+)
+
+// subscriptionsDir is the folder under Root that keeps a login.json file
+// for each user, listing as user/repo the repositories the user gets
+// notifications from. It is kept out of the user's folder, which would
+// otherwise be created, and listed, for users without repositories.
+const subscriptionsDir = ".subscriptions"
+
+var subscriptionMu sync.Mutex
+
+// Templates of the notification mails, executed with [PushMail] and
+// [ThreadMail].
+var (
+	pushMailTempl = template.Must(template.New("push").Parse(
+		`New commits on {{.User}}/{{.Repo}}:
+{{range .Refs}}
+{{.Name}}: {{.Old}} -> {{.New}}
+{{range .Commits}}
+commit {{.Hash}}
+Author: {{.Author}} <{{.Email}}>
+Date:   {{.Date.Format "Mon Jan 2 15:04:05 2006 -0700"}}
+
+    {{.Summary}}
+
+{{.Stats}}
+{{end}}{{end}}`,
+	))
+
+	threadMailTempl = template.Must(template.New("thread").Parse(
+		`{{.From}} wrote on {{.User}}/{{.Repo}} thread "{{.Thread}}":
+
+{{.Body}}
+--
+Reply to this mail to answer on the thread.
+`,
+	))
+)
+
+// PushMail is the data given to the push notification template.
+type PushMail struct {
+	User string
+	Repo string
+	Refs []PushMailRef
+}
+
+type PushMailRef struct {
+	Name    string
+	Old     string
+	New     string
+	Commits []PushMailCommit
+}
+
+type PushMailCommit struct {
+	CommitPayload
+	Summary string
+	Stats   string
+}
+
+// ThreadMail is the data given to the thread notification template.
+type ThreadMail struct {
+	User   string
+	Repo   string
+	Thread string
+	From   string
+	Body   string
+}
+
+func readSubscriptions(root, login string) ([]string, error) {
+	data, err := os.ReadFile(path.Join(root, subscriptionsDir, login+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []string
+	err = json.Unmarshal(data, &subs)
+	return subs, err
+}
+
+func saveSubscriptions(root, login string, subs []string) error {
+	dir := path.Join(root, subscriptionsDir)
+	if err := os.MkdirAll(dir, os.ModeDir|0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(subs)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(dir, login+".json"), data, 0o600)
+}
+
+// Subscribe makes login receive notifications of pushes and messages on the
+// repository user/repo.
+func (g *Gwi) Subscribe(login, user, repo string) error {
+	if _, err := g.repoDir(user, repo); err != nil {
+		return err
+	}
+	if !validName(login) {
+		return ErrInvalidName
+	}
+
+	subscriptionMu.Lock()
+	defer subscriptionMu.Unlock()
+	subs, err := readSubscriptions(g.config.Root, login)
+	if err != nil {
+		return err
+	}
+	if contains(subs, user+"/"+repo) {
+		return nil
+	}
+	return saveSubscriptions(g.config.Root, login, append(subs, user+"/"+repo))
+}
+
+// Unsubscribe stops the notifications of user/repo to login.
+func (g *Gwi) Unsubscribe(login, user, repo string) error {
+	if !validName(login) {
+		return ErrInvalidName
+	}
+
+	subscriptionMu.Lock()
+	defer subscriptionMu.Unlock()
+	subs, err := readSubscriptions(g.config.Root, login)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, s := range subs {
+		if s != user+"/"+repo {
+			kept = append(kept, s)
+		}
+	}
+	return saveSubscriptions(g.config.Root, login, kept)
+}
+
+// subscribers returns the addresses of the users subscribed to user/repo.
+func (g *Gwi) subscribers(user, repo string) []string {
+	if g.vault == nil {
+		return nil
+	}
+	files, err := os.ReadDir(path.Join(g.config.Root, subscriptionsDir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("readDir", "error", err.Error())
+		}
+		return nil
+	}
+
+	private := isPrivate(path.Join(g.config.Root, user, repo))
+	var addrs []string
+	for _, f := range files {
+		login, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok || f.IsDir() || !validName(login) {
+			continue
+		}
+		if private && login != owner(user) {
+			continue
+		}
+		subs, err := readSubscriptions(g.config.Root, login)
+		if err != nil {
+			slog.Error("read subscriptions", "user", login, "error", err.Error())
+			continue
+		}
+		if !contains(subs, user+"/"+repo) {
+			continue
+		}
+		if sub := g.vault.GetUser(login); sub != nil && sub.Email() != "" {
+			addrs = append(addrs, sub.Email())
+		}
+	}
+	return addrs
+}
+
+func (g *Gwi) notifyFrom() string {
+	return "noreply@" + g.config.Domain
+}
+
+// sendNotification mails body to the subscribers of user/repo, except for
+// the address given in skip.
+func (g *Gwi) sendNotification(user, repo, subject, skip string, header map[string]string, body []byte) {
+	if g.config.MailRelay == "" {
+		return
+	}
+	var to []string
+	for _, a := range g.subscribers(user, repo) {
+		if !strings.EqualFold(a, skip) {
+			to = append(to, a)
+		}
+	}
+	if len(to) == 0 {
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	msg := bytes.Buffer{}
+	fmt.Fprintf(&msg, "From: gwi <%s>\r\n", g.notifyFrom())
+	fmt.Fprintf(&msg, "To: %s\r\n", g.notifyFrom())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-Id: <%s@%s>\r\n", hex.EncodeToString(id), g.config.Domain)
+	fmt.Fprintf(&msg, "List-Id: <%s.%s.%s>\r\n", repo, user, g.config.Domain)
+	for k, v := range header {
+		fmt.Fprintf(&msg, "%s: %s\r\n", k, v)
+	}
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.Write(bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n")))
+
+	// recipients are hidden from each other as they are not on the To header
+	err := smtp.SendMail(g.config.MailRelay, nil, g.notifyFrom(), to, msg.Bytes())
+	if err != nil {
+		slog.Error("send notification", "repo", user+"/"+repo, "error", err.Error())
+		return
+	}
+	slog.Info("notification sent", "repo", user+"/"+repo, "subject", subject, "to", len(to))
+}
+
+// notifyPush mails a summary of the commits pushed, with their diffstats, to
+// the subscribers of the repository.
+func (g *Gwi) notifyPush(user, repo string, cmds []*packp.Command) {
+	if g.config.MailRelay == "" {
+		return
+	}
+	gitRepo, err := git.PlainOpen(path.Join(g.config.Root, user, repo))
+	if err != nil {
+		slog.Error("git PlainOpen", "error", err.Error())
+		return
+	}
+
+	data := PushMail{User: user, Repo: repo}
+	commits := 0
+	for _, c := range cmds {
+		ref := PushMailRef{Name: c.Name.Short(), Old: c.Old.String()[:7], New: c.New.String()[:7]}
+		for _, p := range newCommits(gitRepo, c.Old, c.New) {
+			summary, _, _ := strings.Cut(p.Message, "\n")
+			commit := PushMailCommit{CommitPayload: p, Summary: summary}
+			if obj, err := gitRepo.CommitObject(plumbing.NewHash(p.Hash)); err == nil {
+				commit.Stats = diffstat(obj)
+			}
+			ref.Commits = append(ref.Commits, commit)
+		}
+		commits += len(ref.Commits)
+		data.Refs = append(data.Refs, ref)
+	}
+
+	if commits == 0 {
+		return
+	}
+
+	body := bytes.Buffer{}
+	if err := pushMailTempl.Execute(&body, data); err != nil {
+		slog.Error("push mail template", "error", err.Error())
+		return
+	}
+	subject := fmt.Sprintf("[%s/%s] %d new commits", user, repo, commits)
+	if len(data.Refs) == 1 {
+		subject += " on " + data.Refs[0].Name
+	}
+	g.sendNotification(user, repo, subject, "", nil, body.Bytes())
+}
+
+// notifyThread forwards a message received on a thread to the subscribers
+// of the repository, replies go to the mailing list.
+func (g *Gwi) notifyThread(repoDir, thread string, m Mail) {
+	if g.config.MailRelay == "" {
+		return
+	}
+	user, repo := g.repoPath(repoDir)
+
+	body := bytes.Buffer{}
+	data := ThreadMail{User: user, Repo: repo, Thread: thread, From: m.From, Body: m.Body}
+	if err := threadMailTempl.Execute(&body, data); err != nil {
+		slog.Error("thread mail template", "error", err.Error())
+		return
+	}
+
+	header := map[string]string{"Reply-To": user + "/" + repo + "@" + g.config.Domain}
+	if m.ID != "" {
+		header["In-Reply-To"] = "<" + m.ID + ">"
+		header["References"] = "<" + m.ID + ">"
+	}
+	skip := ""
+	if from, err := mail.ParseAddress(m.From); err == nil {
+		skip = from.Address
+	}
+	g.sendNotification(user, repo, m.Subject, skip, header, body.Bytes())
+}
+
+// diffstat gives the files changed by a commit, like git diff --stat.
+func diffstat(c *object.Commit) string {
+	stats, err := c.Stats()
+	if err != nil {
+		slog.Error("stats", "commit", c.Hash.String(), "error", err.Error())
+		return ""
+	}
+
+	added, deleted := 0, 0
+	for _, s := range stats {
+		added += s.Addition
+		deleted += s.Deletion
+	}
+	return fmt.Sprintf(
+		"%s %d files changed, %d insertions(+), %d deletions(-)",
+		stats.String(),
+		len(stats),
+		added,
+		deleted,
+	)
+}
+
+// subscribeHandler subscribes or unsubscribes the authenticated user to the
+// repository on the path.
+func (g *Gwi) subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	slog.Debug("running subscribe handler", "vars", vars)
+
+	login, ok := g.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if !g.canRead(r, vars["user"], vars["repo"]) {
+		http.Error(w, ErrRepoNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	var err error
+	if vars["op"] == "unsubscribe" {
+		err = g.Unsubscribe(login, vars["user"], vars["repo"])
+	} else {
+		err = g.Subscribe(login, vars["user"], vars["repo"])
+	}
+	if err != nil {
+		repoError(w, vars["op"], err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,144 @@
+package gwi
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+type sinkMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpSink is a fake SMTP relay that sends the messages it gets to the
+// returned channel.
+func smtpSink(t *testing.T) (string, chan sinkMail) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	mails := make(chan sinkMail, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c := textproto.NewConn(conn)
+			c.PrintfLine("220 sink")
+			m := sinkMail{}
+			for {
+				line, err := c.ReadLine()
+				if err != nil {
+					break
+				}
+				switch verb := strings.ToUpper(line[:4]); verb {
+				case "MAIL":
+					m.from = strings.Trim(line[10:], "<>")
+				case "RCPT":
+					m.to = append(m.to, strings.Trim(line[8:], "<>"))
+				case "DATA":
+					c.PrintfLine("354 go on")
+					data, _ := io.ReadAll(c.DotReader())
+					m.data = string(data)
+					mails <- m
+				case "QUIT":
+					c.PrintfLine("221 bye")
+					conn.Close()
+				}
+				c.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return l.Addr().String(), mails
+}
+
+func Test_Notify(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	base := testCommit(t, repo, map[string]string{"README": "hello\n"}, "init")
+	next := testCommit(t, repo, map[string]string{"README": "hello\nworld\n"}, "Add world")
+
+	relay, mails := smtpSink(t)
+	g := Gwi{
+		config: Config{Root: root, Domain: "localhost", MailRelay: relay},
+		vault:  testVault(),
+	}
+
+	if err := g.Subscribe("y", "x", "none"); err != ErrRepoNotFound {
+		t.Errorf("subscribe to missing repo: %v", err)
+	}
+	for _, login := range []string{"x", "y", "y"} {
+		if err := g.Subscribe(login, "x", "proj"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g.notifyPush("x", "proj", []*packp.Command{
+		{Name: plumbing.NewBranchReferenceName("main"), Old: base, New: next},
+	})
+	m := <-mails
+	sort.Strings(m.to)
+	if m.from != "noreply@localhost" || !reflect.DeepEqual(m.to, []string{"x@localhost", "y@localhost"}) {
+		t.Errorf("unexpected envelope %s %v", m.from, m.to)
+	}
+	for _, want := range []string{"Subject: [x/proj] 1 new commits on main", "Add world", "README | 1 +"} {
+		if !strings.Contains(m.data, want) {
+			t.Errorf("push mail misses %q:\n%s", want, m.data)
+		}
+	}
+
+	msg := Mail{ID: "1@localhost", From: "Y <y@localhost>", Subject: "Hello", Body: "hi there\n"}
+	g.notifyThread(root+"/x/proj", "Hello", msg)
+	m = <-mails
+	if !reflect.DeepEqual(m.to, []string{"x@localhost"}) {
+		t.Errorf("thread mail sent to %v", m.to)
+	}
+	for _, want := range []string{"Reply-To: x/proj@localhost", "In-Reply-To: <1@localhost>", "hi there"} {
+		if !strings.Contains(m.data, want) {
+			t.Errorf("thread mail misses %q:\n%s", want, m.data)
+		}
+	}
+
+	// subscriptions don't create user folders
+	if _, err := os.Stat(path.Join(root, "y")); !os.IsNotExist(err) {
+		t.Errorf("subscription created the folder of y: %v", err)
+	}
+
+	// only the owner is notified of private repositories, also in groups
+	testRepo(t, root, "x/team", "lib")
+	if err := g.SetPrivate("x/team", "lib", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, login := range []string{"x", "y"} {
+		if err := g.Subscribe(login, "x/team", "lib"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if addrs := g.subscribers("x/team", "lib"); !reflect.DeepEqual(addrs, []string{"x@localhost"}) {
+		t.Errorf("subscribers of private repository: %v", addrs)
+	}
+
+	if err := g.Unsubscribe("x", "x", "proj"); err != nil {
+		t.Fatal(err)
+	}
+	g.notifyThread(root+"/x/proj", "Hello", msg)
+	select {
+	case m := <-mails:
+		t.Errorf("unexpected mail to %v", m.to)
+	default:
+	}
+}
@@ -0,0 +1,123 @@
+package gwi
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"log/slog"
+)
+
+// defaultPages is the default theme, files of PagesRoot with the same names
+// replace its templates.
+//
+//go:embed templates/*.html
+var defaultPages embed.FS
+
+// pageSet holds the templates of the default theme and PagesRoot. In
+// development mode the files of PagesRoot are checked on every request and
+// parsed again when they change, if the new parse fails the previous
+// templates are kept along with the error. The parsed templates are never
+// executed, each request gets a copy so it can add its own functions.
+type pageSet struct {
+	root  string
+	funcs template.FuncMap
+	dev   bool
+
+	mu    sync.Mutex
+	pages *template.Template
+	stamp string
+	err   error
+}
+
+func newPageSet(root string, funcs template.FuncMap, dev bool) (*pageSet, error) {
+	s := &pageSet{root: root, funcs: funcs, dev: dev, stamp: pagesStamp(root)}
+
+	var err error
+	s.pages, err = s.parse()
+	return s, err
+}
+
+func (s *pageSet) parse() (*template.Template, error) {
+	pages, err := template.New("all").Funcs(s.funcs).ParseFS(defaultPages, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	names := pageFiles(s.root)
+	if len(names) == 0 {
+		return pages, nil
+	}
+	return pages.ParseFiles(names...)
+}
+
+// get returns a copy of the current templates, in development mode they
+// are parsed again first if the files changed.
+func (s *pageSet) get() (*template.Template, error) {
+	if !s.dev {
+		return s.pages.Clone()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stamp := pagesStamp(s.root)
+	if stamp == s.stamp {
+		return s.pages.Clone()
+	}
+	s.stamp = stamp
+
+	pages, err := s.parse()
+	if err != nil {
+		slog.Error("parse templates", "error", err.Error())
+		s.err = err
+		return s.pages.Clone()
+	}
+	slog.Info("templates reloaded", "root", s.root)
+	s.pages, s.err = pages, nil
+	return s.pages.Clone()
+}
+
+// parseError returns the error of the last parse in development mode, if it
+// failed.
+func (s *pageSet) parseError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// pageFiles returns the templates of PagesRoot.
+func pageFiles(root string) []string {
+	if root == "" {
+		return nil
+	}
+	names, _ := filepath.Glob(filepath.Join(root, "*.html"))
+	return names
+}
+
+// pagesStamp lists the name, size and modification time of the files of
+// PagesRoot, it changes when a file is edited, created or removed.
+func pagesStamp(root string) string {
+	stamp := strings.Builder{}
+	for _, name := range pageFiles(root) {
+		st, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&stamp, "%s %d %d\n", name, st.Size(), st.ModTime().UnixNano())
+	}
+	return stamp.String()
+}
+
+// withParseError puts the template parse error at the top of a page, so it
+// is seen on the browser while the previous templates are used.
+func withParseError(page []byte, err error) []byte {
+	if err == nil {
+		return page
+	}
+	banner := `<pre style="background:#fdd;color:#900;padding:1em;white-space:pre-wrap">` +
+		template.HTMLEscapeString(err.Error()) + "</pre>\n"
+	return append([]byte(banner), page...)
+}
@@ -0,0 +1,182 @@
+package gwi
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func Test_DevMode(t *testing.T) {
+	root := t.TempDir()
+	testRepo(t, root, "x", "proj")
+
+	pages := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(path.Join(pages, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(g Gwi, url string) string {
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec.Body.String()
+	}
+	write("empty.html", "one {{.Repo}}")
+
+	dev, err := NewFromConfig(Config{Root: root, PagesRoot: pages, DevMode: true}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prod, err := NewFromConfig(Config{Root: root, PagesRoot: pages}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := get(dev, "/x/proj/-/empty"); body != "one proj" {
+		t.Errorf("first parse: %q", body)
+	}
+
+	write("empty.html", "second {{.Repo}}")
+	write("new.html", "new {{.User}}")
+	if body := get(dev, "/x/proj/-/empty"); body != "second proj" {
+		t.Errorf("edited template: %q", body)
+	}
+	if body := get(dev, "/x/proj/-/new"); body != "new x" {
+		t.Errorf("created template: %q", body)
+	}
+	if body := get(prod, "/x/proj/-/empty"); body != "one proj" {
+		t.Errorf("reparsed without dev mode: %q", body)
+	}
+
+	// a broken template keeps the previous ones and shows the error
+	write("empty.html", "broken {{.Repo")
+	body := get(dev, "/x/proj/-/empty")
+	if !strings.HasSuffix(body, "second proj") || !strings.Contains(body, "empty.html") {
+		t.Errorf("parse error: %q", body)
+	}
+
+	write("empty.html", "fixed {{.Repo}}")
+	if body := get(dev, "/x/proj/-/empty"); body != "fixed proj" {
+		t.Errorf("fixed template: %q", body)
+	}
+}
+
+func Test_DefaultTheme(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	first := testCommit(t, repo, map[string]string{"README.md": "# Proj\n"}, "init")
+	testCommit(t, repo, map[string]string{
+		"README.md":   "# Proj\n\nA project.\n",
+		"DESC":        "a test project",
+		"LICENSE":     "MIT",
+		"TODO.md":     "- more tests\n",
+		"src/main.go": "package main\n",
+	}, "add sources")
+	if _, err := repo.CreateTag("v1", first, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/dev", first)); err != nil {
+		t.Fatal(err)
+	}
+	thread := threadName("Re: [PATCH 1/2] Add there")
+	for _, m := range []string{testPatch1, testPatch2} {
+		if err := saveMail(path.Join(root, "x", "proj"), thread, []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testRepo(t, root, "x", "empty")
+	testCommit(t, testRepo(t, root, "x/team", "lib"), map[string]string{"lib.go": "package lib\n"}, "init")
+
+	g, err := NewFromConfig(Config{Root: root}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ForkRepo("x", "proj", "y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.updateIndex("x", "proj"); err != nil {
+		t.Fatal(err)
+	}
+
+	// pages executing each template, partials are used by all of them
+	partials := map[string]bool{"head.html": true, "header.html": true, "nav.html": true, "style.html": true}
+	pages := map[string][]struct {
+		url  string
+		code int
+		want string
+	}{
+		"users.html":         {{"/", http.StatusOK, `href="/x"`}},
+		"repos.html":         {{"/x", http.StatusOK, `href="/x/team"`}, {"/x/team", http.StatusOK, `href="/x/team/lib"`}},
+		"global-search.html": {{"/search?q=package", http.StatusOK, "src/main.go:1"}},
+		"summary.html":       {{"/x/proj", http.StatusOK, "a test project"}, {"/y/proj", http.StatusOK, "Forked from"}},
+		"empty.html":         {{"/x/empty", http.StatusOK, "git clone"}},
+		"tree.html":          {{"/x/proj/-/tree", http.StatusOK, "src/main.go"}},
+		"files.html":         {{"/x/proj/-/files/src/main.go", http.StatusOK, "package main"}},
+		"log.html":           {{"/x/proj/-/log", http.StatusOK, "add sources"}, {"/x/proj/-/log?q=init", http.StatusOK, "init"}},
+		"commit.html":        {{"/x/proj/-/commit", http.StatusOK, "b/src/main.go"}, {"/x/proj/-/commit?ref=" + first.String(), http.StatusOK, "init"}},
+		"branches.html":      {{"/x/proj/-/branches", http.StatusOK, "?ref=dev"}},
+		"tags.html":          {{"/x/proj/-/tags", http.StatusOK, "?ref=v1"}},
+		"search.html":        {{"/x/proj/-/search?q=package", http.StatusOK, "1 matches"}},
+		"lists.html":         {{"/x/proj/-/lists", http.StatusOK, thread}},
+		"mails.html":         {{"/x/proj/-/mails/" + url.PathEscape(thread), http.StatusOK, "Apply patches"}},
+		"error.html":         {{"/x/proj/-/nope", http.StatusNotFound, "back to proj"}},
+	}
+
+	names, err := fs.Glob(defaultPages, "templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		name = path.Base(name)
+		if !partials[name] && pages[name] == nil {
+			t.Errorf("%s is not tested", name)
+		}
+	}
+	for name, tests := range pages {
+		for _, tt := range tests {
+			rec := httptest.NewRecorder()
+			g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("%s %s: %d %q", name, tt.url, rec.Code, rec.Body)
+			}
+		}
+	}
+}
+
+// Test_PageFuncs renders pages of two repositories at once, each must only
+// show its own files.
+func Test_PageFuncs(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		testCommit(t, testRepo(t, root, "x", name), map[string]string{"only-" + name: name}, "init")
+	}
+	g, err := NewFromConfig(Config{Root: root}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		name, other := "a", "b"
+		if i%2 == 1 {
+			name, other = other, name
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/x/"+name+"/-/tree", nil))
+			if body := rec.Body.String(); !strings.Contains(body, "only-"+name) || strings.Contains(body, "only-"+other) {
+				t.Errorf("tree of %s: %d %q", name, rec.Code, body)
+			}
+		}()
+	}
+	wg.Wait()
+}
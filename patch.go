@@ -0,0 +1,447 @@
+package gwi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Patch is a commit sent by mail, as created by git format-patch. Version,
+// Number and Total come from a subject like [PATCH v2 1/3], a patch without
+// them is 1/1 of version 1, and all are 0 for patches sent in replies, which
+// are not part of a series. Error is filled when the patch does not apply on
+// the repository.
+type Patch struct {
+	Author  string
+	Email   string
+	Date    time.Time
+	Subject string
+	Message string
+	Version int
+	Number  int
+	Total   int
+	Diff    string
+	Files   []*FileDiff
+	Error   string
+}
+
+// FileDiff holds the changes of one file in a patch, OldName is empty for
+// created files and NewName is empty for deleted ones.
+type FileDiff struct {
+	OldName string
+	NewName string
+	Mode    filemode.FileMode
+	Binary  bool
+	Hunks   []Hunk
+}
+
+// Hunk is a section of a unified diff, Lines keep their ' ', '-' or '+'
+// prefix.
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []string
+	// NoEOL tells which sides, old or new, miss the newline at end of file
+	OldNoEOL bool
+	NewNoEOL bool
+}
+
+var (
+	ErrNotPatch  = errors.New("not a patch")
+	ErrPatchPath = errors.New("invalid path in patch")
+
+	subjectPrefix = regexp.MustCompile(`^\[[^\]]*PATCH[^\]]*\]\s*`)
+	hunkHeader    = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+)
+
+// isPatch tells whether text looks like the output of git format-patch or
+// git diff.
+func isPatch(text string) bool {
+	return strings.HasPrefix(text, "diff --git ") ||
+		strings.Contains(text, "\ndiff --git ")
+}
+
+// parsePatch parses a patch in the mbox format given by git format-patch, if
+// text has no mail headers, header is used to fill author, date and subject.
+func parsePatch(text string, header mail.Header) (*Patch, error) {
+	if !isPatch(text) {
+		return nil, ErrNotPatch
+	}
+
+	if strings.HasPrefix(text, "From ") {
+		// mbox separator line
+		_, rest, _ := strings.Cut(text, "\n")
+		msg, err := mail.ReadMessage(strings.NewReader(rest))
+		if err == nil {
+			header = msg.Header
+			body, _ := io.ReadAll(msg.Body)
+			text = string(body)
+		}
+	}
+
+	subject := decodeHeader(header.Get("Subject"))
+	p := &Patch{Subject: subjectPrefix.ReplaceAllString(subject, "")}
+	if prefix := subjectPrefix.FindString(subject); prefix != "" {
+		p.Version, p.Number, p.Total = seriesPosition(prefix)
+	}
+	if from, err := mail.ParseAddress(decodeHeader(header.Get("From"))); err == nil {
+		p.Author, p.Email = from.Name, from.Address
+	}
+	p.Date, _ = header.Date()
+
+	i := strings.Index(text, "diff --git ")
+	if i > 0 {
+		i = strings.Index(text, "\ndiff --git ") + 1
+	}
+	p.Message, p.Diff = text[:i], text[i:]
+
+	// the message ends at the --- line that precedes the diffstat
+	if j := strings.Index(p.Message, "\n---\n"); j >= 0 {
+		p.Message = p.Message[:j]
+	} else if strings.HasPrefix(p.Message, "---\n") {
+		p.Message = ""
+	}
+	p.Message = strings.TrimSpace(p.Message)
+
+	// and the diff ends at the signature
+	if j := strings.Index(p.Diff, "\n-- \n"); j >= 0 {
+		p.Diff = p.Diff[:j+1]
+	}
+
+	var err error
+	p.Files, err = parseDiff(p.Diff)
+	return p, err
+}
+
+// seriesPosition reads the version and position of a patch from a subject
+// prefix like [PATCH v2 1/3].
+func seriesPosition(prefix string) (version, number, total int) {
+	version, number, total = 1, 1, 1
+	for _, field := range strings.Fields(strings.Trim(prefix, "[] ")) {
+		if n := atoi(strings.TrimPrefix(field, "v")); field[0] == 'v' && n > 0 {
+			version = n
+			continue
+		}
+		m, n, ok := strings.Cut(field, "/")
+		if !ok {
+			continue
+		}
+		if a, b := atoi(m), atoi(n); a > 0 && b >= a {
+			number, total = a, b
+		}
+	}
+	return version, number, total
+}
+
+// validPatchPath tells whether a path of a patch can be written to a tree,
+// it must be relative, clean and not inside a .git folder.
+func validPatchPath(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." || strings.EqualFold(part, ".git") {
+			return false
+		}
+	}
+	return true
+}
+
+func parseDiff(diff string) ([]*FileDiff, error) {
+	var files []*FileDiff
+	var file *FileDiff
+	var hunk *Hunk
+	oldLeft, newLeft := 0, 0
+
+	lines := strings.Split(diff, "\n")
+	for n, line := range lines {
+		if strings.HasPrefix(line, `\`) && hunk != nil && len(hunk.Lines) > 0 {
+			switch hunk.Lines[len(hunk.Lines)-1][0] {
+			case ' ':
+				hunk.OldNoEOL, hunk.NewNoEOL = true, true
+			case '-':
+				hunk.OldNoEOL = true
+			case '+':
+				hunk.NewNoEOL = true
+			}
+			continue
+		}
+
+		if hunk != nil && (oldLeft > 0 || newLeft > 0) {
+			if line == "" && n < len(lines)-1 {
+				// context lines may lose their space on the way
+				line = " "
+			}
+			switch {
+			case strings.HasPrefix(line, " "):
+				oldLeft--
+				newLeft--
+			case strings.HasPrefix(line, "-"):
+				oldLeft--
+			case strings.HasPrefix(line, "+"):
+				newLeft--
+			default:
+				return files, fmt.Errorf("line %d: unexpected %q in hunk", n+1, line)
+			}
+			hunk.Lines = append(hunk.Lines, line)
+			continue
+		}
+		hunk = nil
+
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			file = &FileDiff{}
+			files = append(files, file)
+			names := strings.TrimPrefix(line, "diff --git ")
+			if i := strings.Index(names, " b/"); i >= 0 {
+				file.OldName = strings.TrimPrefix(names[:i], "a/")
+				file.NewName = names[i+3:]
+			}
+		case file == nil:
+			continue
+		case strings.HasPrefix(line, "new file mode "):
+			file.OldName = ""
+			file.Mode = parseMode(strings.TrimPrefix(line, "new file mode "))
+		case strings.HasPrefix(line, "deleted file mode "):
+			file.NewName = ""
+		case strings.HasPrefix(line, "new mode "):
+			file.Mode = parseMode(strings.TrimPrefix(line, "new mode "))
+		case strings.HasPrefix(line, "index "):
+			if fields := strings.Fields(line); len(fields) == 3 {
+				file.Mode = parseMode(fields[2])
+			}
+		case strings.HasPrefix(line, "rename from "):
+			file.OldName = strings.TrimPrefix(line, "rename from ")
+		case strings.HasPrefix(line, "rename to "):
+			file.NewName = strings.TrimPrefix(line, "rename to ")
+		case strings.HasPrefix(line, "Binary files "), line == "GIT binary patch":
+			file.Binary = true
+		case strings.HasPrefix(line, "@@ "):
+			m := hunkHeader.FindStringSubmatch(line)
+			if m == nil {
+				return files, fmt.Errorf("line %d: bad hunk header %q", n+1, line)
+			}
+			file.Hunks = append(file.Hunks, Hunk{
+				OldStart: atoi(m[1]),
+				OldLines: atoiOr(m[2], 1),
+				NewStart: atoi(m[3]),
+				NewLines: atoiOr(m[4], 1),
+			})
+			hunk = &file.Hunks[len(file.Hunks)-1]
+			oldLeft, newLeft = hunk.OldLines, hunk.NewLines
+		}
+	}
+	if len(files) == 0 {
+		return nil, ErrNotPatch
+	}
+	for _, f := range files {
+		if f.OldName == "" && f.NewName == "" {
+			return files, ErrPatchPath
+		}
+		for _, name := range []string{f.OldName, f.NewName} {
+			if name != "" && !validPatchPath(name) {
+				return files, fmt.Errorf("%w: %q", ErrPatchPath, name)
+			}
+		}
+	}
+	return files, nil
+}
+
+func parseMode(s string) filemode.FileMode {
+	m, err := filemode.New(s)
+	if err != nil {
+		return filemode.Regular
+	}
+	return m
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func atoiOr(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	return atoi(s)
+}
+
+// applyHunks applies the hunks of a file diff to content. Hunks are looked up
+// near their stated position, so patches made on a slightly different
+// version of the file still apply.
+func applyHunks(content string, hunks []Hunk) (string, error) {
+	noEOL := content != "" && !strings.HasSuffix(content, "\n")
+	lines := strings.Split(content, "\n")
+	if !noEOL {
+		lines = lines[:len(lines)-1]
+	}
+
+	var out []string
+	pos := 0
+	for i, h := range hunks {
+		var before, after []string
+		for _, l := range h.Lines {
+			switch l[0] {
+			case ' ':
+				before = append(before, l[1:])
+				after = append(after, l[1:])
+			case '-':
+				before = append(before, l[1:])
+			case '+':
+				after = append(after, l[1:])
+			}
+		}
+
+		at := findLines(lines, before, pos, h.OldStart-1)
+		if at < 0 {
+			return "", fmt.Errorf("hunk #%d at line %d does not apply", i+1, h.OldStart)
+		}
+		out = append(out, lines[pos:at]...)
+		out = append(out, after...)
+		pos = at + len(before)
+
+		if pos == len(lines) {
+			noEOL = h.NewNoEOL
+		}
+	}
+	out = append(out, lines[pos:]...)
+
+	if len(out) == 0 {
+		return "", nil
+	}
+	result := strings.Join(out, "\n")
+	if !noEOL {
+		result += "\n"
+	}
+	return result, nil
+}
+
+// findLines searches for want in lines, starting at from, and returns the
+// match closest to hint, or -1.
+func findLines(lines, want []string, from, hint int) int {
+	best := -1
+	for i := from; i+len(want) <= len(lines); i++ {
+		match := true
+		for j := range want {
+			if lines[i+j] != want[j] {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		if best < 0 || abs(i-hint) < abs(best-hint) {
+			best = i
+		}
+		if i >= hint {
+			break
+		}
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// patchTree holds the files changed by patches applied on top of a tree, a
+// nil content means the file was deleted.
+type patchTree struct {
+	tree    *object.Tree
+	changes map[string]*fileChange
+}
+
+type fileChange struct {
+	content *string
+	mode    filemode.FileMode
+}
+
+func newPatchTree(tree *object.Tree) *patchTree {
+	return &patchTree{tree: tree, changes: map[string]*fileChange{}}
+}
+
+func (t *patchTree) read(name string) (string, filemode.FileMode, bool, error) {
+	if c, ok := t.changes[name]; ok {
+		if c.content == nil {
+			return "", 0, false, nil
+		}
+		return *c.content, c.mode, true, nil
+	}
+	if t.tree == nil {
+		return "", 0, false, nil
+	}
+
+	f, err := t.tree.File(name)
+	if err == object.ErrFileNotFound {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	content, err := f.Contents()
+	return content, f.Mode, true, err
+}
+
+// apply applies all file diffs of p, if any of them fails nothing is changed
+// and the error tells which file failed.
+func (t *patchTree) apply(p *Patch) error {
+	changes := map[string]*fileChange{}
+	for _, f := range p.Files {
+		name := f.OldName
+		if name == "" {
+			name = f.NewName
+		}
+		if f.Binary {
+			return fmt.Errorf("%s: binary patches are not supported", name)
+		}
+
+		content, mode, exists, err := t.read(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if f.OldName == "" && exists {
+			return fmt.Errorf("%s: already exists", name)
+		}
+		if f.OldName != "" && !exists {
+			return fmt.Errorf("%s: does not exist", name)
+		}
+
+		content, err = applyHunks(content, f.Hunks)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		if f.NewName != f.OldName && f.OldName != "" {
+			changes[f.OldName] = &fileChange{}
+		}
+		if f.NewName != "" {
+			if f.Mode != 0 {
+				mode = f.Mode
+			}
+			if mode == 0 {
+				mode = filemode.Regular
+			}
+			changes[f.NewName] = &fileChange{content: &content, mode: mode}
+		}
+	}
+
+	for name, c := range changes {
+		t.changes[name] = c
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package gwi
+
+import (
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// privateFile marks a repository as private, only its owner can read it.
+const privateFile = "private"
+
+// SetPrivate changes the visibility of a repository, private repositories
+// can only be read by their owner.
+func (g *Gwi) SetPrivate(user, repo string, private bool) error {
+	dir, err := g.repoDir(user, repo)
+	if err != nil {
+		return err
+	}
+	file := path.Join(dir, privateFile)
+	if !private {
+		err := os.Remove(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return os.WriteFile(file, nil, 0o600)
+}
+
+func isPrivate(repoDir string) bool {
+	_, err := os.Stat(path.Join(repoDir, privateFile))
+	return err == nil
+}
+
+// canRead tells whether the request can read the repository, private
+// repositories need the credentials of their owner.
+func (g *Gwi) canRead(r *http.Request, user, repo string) bool {
+	if !isPrivate(path.Join(g.config.Root, user, repo)) {
+		return true
+	}
+	login, pass, ok := r.BasicAuth()
+	return ok && login == owner(user) && g.vault != nil && g.vault.Validate(login, pass)
+}
+
+// readable checks that the request can read the repository, otherwise it
+// asks for credentials, or answers not found so private repositories are
+// not disclosed.
+func (g *Gwi) readable(w http.ResponseWriter, r *http.Request, user, repo string) bool {
+	if g.canRead(r, user, repo) {
+		return true
+	}
+	if _, _, ok := r.BasicAuth(); !ok {
+		w.Header().Set("WWW-Authenticate", "Basic")
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	g.httpError(w, r, ErrRepoNotFound)
+	return false
+}
+
+// resolveOwnRef is resolveRef for pages, the commit must be reachable from
+// the references of the repository. Forks borrow all objects of their parent
+// through alternates, including commits pushed there after the fork, which
+// may since have become private.
+func resolveOwnRef(repo *cachedRepo, ref string) (*object.Commit, bool, error) {
+	commit, immutable, err := resolveRef(repo.Repository, ref)
+	if err != nil || len(readAlternates(repo.dir)) == 0 {
+		return commit, immutable, err
+	}
+	own := repo.memoize("reachable "+commit.Hash.String(), func() any {
+		return checkWants(repo.Repository, []plumbing.Hash{commit.Hash}) == nil
+	}).(bool)
+	if !own {
+		return nil, false, ErrBadRef
+	}
+	return commit, immutable, nil
+}
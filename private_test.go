@@ -0,0 +1,137 @@
+package gwi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func Test_Private(t *testing.T) {
+	root := t.TempDir()
+	testCommit(t, testRepo(t, root, "x", "secret"), map[string]string{"secret.txt": "hidden\n"}, "init")
+	testCommit(t, testRepo(t, root, "x", "pub"), map[string]string{"pub.txt": "shown\n"}, "init")
+
+	g, err := NewFromConfig(Config{Root: root}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetPrivate("x", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, url, login string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(`{"operation":"download","objects":[]}`))
+		if login != "" {
+			req.SetBasicAuth(login, "1234")
+		}
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, url := range []string{
+		"/x/secret",
+		"/x/secret/-/tree",
+		"/x/secret/-/raw/secret.txt",
+		"/x/secret/-/zip",
+		"/x/secret/info/refs?service=git-upload-pack",
+		"/x/secret/objects/info/packs",
+		"POST /x/secret.git/info/lfs/objects/batch",
+	} {
+		method := http.MethodGet
+		if m, u, ok := strings.Cut(url, " "); ok {
+			method, url = m, u
+		}
+		for login, want := range map[string]int{"": http.StatusUnauthorized, "y": http.StatusNotFound, "x": http.StatusOK} {
+			if rec := do(method, url, login); rec.Code != want {
+				t.Errorf("%s by %q: %d, want %d", url, login, rec.Code, want)
+			}
+		}
+	}
+
+	// pages of the owner are only cached by browsers
+	if cc := do(http.MethodGet, "/x/secret", "x").Header().Get("Cache-Control"); !strings.HasPrefix(cc, "private") {
+		t.Errorf("cache control of private page: %q", cc)
+	}
+	if cc := do(http.MethodGet, "/x/pub", "").Header().Get("Cache-Control"); !strings.HasPrefix(cc, "public") {
+		t.Errorf("cache control of public page: %q", cc)
+	}
+
+	// listings, and pages rendered after the owner's, don't show it
+	if rec := do(http.MethodGet, "/x/secret/-/tree", "x"); !strings.Contains(rec.Body.String(), "secret.txt") {
+		t.Errorf("owner tree: %q", rec.Body)
+	}
+	for _, url := range []string{"/", "/x", "/x/pub", "/x/pub/-/tree", "/search?q=hidden"} {
+		if body := do(http.MethodGet, url, "").Body.String(); strings.Contains(body, "secret") {
+			t.Errorf("%s shows the private repository:\n%s", url, body)
+		}
+	}
+	if body := do(http.MethodGet, "/x", "x").Body.String(); !strings.Contains(body, "secret") {
+		t.Errorf("owner listing misses the private repository:\n%s", body)
+	}
+
+	// nor do the forks of a public repository
+	if err := g.ForkRepo("x", "pub", "y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetPrivate("y", "pub", true); err != nil {
+		t.Fatal(err)
+	}
+	if body := do(http.MethodGet, "/x/pub", "").Body.String(); strings.Contains(body, "y/pub") {
+		t.Errorf("summary shows a private fork:\n%s", body)
+	}
+}
+
+// Test_PrivateAlternates checks that a public fork doesn't show what its
+// parent got after the fork, as the parent may be private now.
+func Test_PrivateAlternates(t *testing.T) {
+	root := t.TempDir()
+	parent := testRepo(t, root, "x", "proj")
+	shared := testCommit(t, parent, map[string]string{"README": "shared\n"}, "init")
+
+	g, err := NewFromConfig(Config{Root: root}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ForkRepo("x", "proj", "y"); err != nil {
+		t.Fatal(err)
+	}
+	later := testCommit(t, parent, map[string]string{"README": "shared\n", "later.txt": "hidden\n"}, "later")
+	if err := g.SetPrivate("x", "proj", true); err != nil {
+		t.Fatal(err)
+	}
+
+	fork, err := git.PlainOpen(path.Join(root, "y", "proj"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fork.CommitObject(later); err != nil {
+		t.Fatalf("fork does not borrow the objects of its parent: %s", err)
+	}
+
+	get := func(url string) int {
+		rec := httptest.NewRecorder()
+		g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec.Code
+	}
+	if code := get("/y/proj/-/tree?ref=" + shared.String()); code != http.StatusOK {
+		t.Errorf("tree of shared commit: %d", code)
+	}
+	for _, url := range []string{
+		"/y/proj/-/tree?ref=" + later.String(),
+		"/y/proj/-/commit?ref=" + later.String()[:7],
+		"/y/proj/-/raw/later.txt?ref=" + later.String(),
+		"/y/proj/-/zip?ref=" + later.String(),
+	} {
+		if code := get(url); code == http.StatusOK {
+			t.Errorf("%s is served", url)
+		}
+	}
+	if err := checkWants(fork, []plumbing.Hash{later}); err == nil {
+		t.Error("fetch of the later commit is allowed")
+	}
+}
@@ -0,0 +1,476 @@
+package gwi
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// The git server of go-git only speaks protocol v0 and can't make shallow
+// or partial packs, so upload-pack is implemented here, see gitprotocol-v2(5)
+// and gitprotocol-pack(5). Clients that don't ask for v2 in the Git-Protocol
+// header get v0, receive-pack is left to go-git.
+
+// v2Capabilities are advertised to v2 clients, only the commands and
+// arguments implemented here are listed.
+var v2Capabilities = []string{
+	"agent=git/gwi",
+	"ls-refs=unborn",
+	"fetch=shallow filter",
+	"server-option",
+	"object-format=sha1",
+}
+
+type pktKind int
+
+const (
+	pktData pktKind = iota
+	pktFlush
+	pktDelim
+	pktEnd
+)
+
+var errPktLen = errors.New("invalid pkt-line length")
+
+// v2Request is a command sent by a v2 client, capabilities are sent before
+// the delimiter packet and arguments after.
+type v2Request struct {
+	Command      string
+	Capabilities []string
+	Args         []string
+}
+
+// protocolVersion returns the version asked for in the Git-Protocol header.
+func protocolVersion(r *http.Request) int {
+	for _, param := range strings.Split(r.Header.Get("Git-Protocol"), ":") {
+		if v, ok := strings.CutPrefix(param, "version="); ok {
+			n, _ := strconv.Atoi(v)
+			return n
+		}
+	}
+	return 0
+}
+
+// readPkt reads a pkt-line, without its trailing newline.
+func readPkt(r *bufio.Reader) (string, pktKind, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return "", pktData, err
+	}
+	n, err := strconv.ParseUint(string(size), 16, 16)
+	if err != nil {
+		return "", pktData, errPktLen
+	}
+	switch {
+	case n == 0:
+		return "", pktFlush, nil
+	case n == 1:
+		return "", pktDelim, nil
+	case n == 2:
+		return "", pktEnd, nil
+	case n < 4:
+		return "", pktData, errPktLen
+	}
+
+	line := make([]byte, n-4)
+	if _, err := io.ReadFull(r, line); err != nil {
+		return "", pktData, err
+	}
+	return strings.TrimSuffix(string(line), "\n"), pktData, nil
+}
+
+func decodeV2Request(r io.Reader) (*v2Request, error) {
+	br := bufio.NewReader(r)
+	req := &v2Request{}
+	args := false
+	for {
+		line, kind, err := readPkt(br)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case kind == pktFlush:
+			if req.Command == "" {
+				return nil, errors.New("missing command")
+			}
+			return req, nil
+		case kind == pktDelim && !args:
+			args = true
+		case kind != pktData:
+			return nil, errPktLen
+		case args:
+			req.Args = append(req.Args, line)
+		case strings.HasPrefix(line, "command="):
+			req.Command = strings.TrimPrefix(line, "command=")
+		default:
+			req.Capabilities = append(req.Capabilities, line)
+		}
+	}
+}
+
+// advertiseV2 writes the capability advertisement of protocol v2.
+func advertiseV2(w io.Writer) error {
+	e := pktline.NewEncoder(w)
+	if err := e.EncodeString("version 2\n"); err != nil {
+		return err
+	}
+	for _, c := range v2Capabilities {
+		if err := e.EncodeString(c + "\n"); err != nil {
+			return err
+		}
+	}
+	return e.Flush()
+}
+
+// serveV2 runs a v2 command on the repository at repoDir.
+func serveV2(w http.ResponseWriter, body io.Reader, repoDir string) {
+	req, err := decodeV2Request(body)
+	if err != nil {
+		slog.Error("v2 decode", "error", err.Error())
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	slog.Debug("v2 request", "command", req.Command, "caps", req.Capabilities, "args", req.Args)
+
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		slog.Error("git PlainOpen", "error", err.Error())
+		http.Error(w, "repository not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	switch req.Command {
+	case "ls-refs":
+		err = lsRefs(w, repo, req.Args)
+	case "fetch":
+		err = fetch(w, repo, req.Args)
+	default:
+		err = &clientError{"unknown command " + req.Command}
+	}
+	sendError(w, req.Command, err)
+}
+
+// clientError is an error caused by the request, it is sent to the client.
+type clientError struct {
+	msg string
+}
+
+func (e *clientError) Error() string {
+	return e.msg
+}
+
+// lsRefs lists the references of the repository, HEAD first.
+func lsRefs(w io.Writer, repo *git.Repository, args []string) error {
+	var prefixes []string
+	symrefs, peel, unborn := false, false, false
+	for _, arg := range args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case arg == "unborn":
+			unborn = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		default:
+			return &clientError{"unexpected ls-refs argument " + arg}
+		}
+	}
+	match := func(name plumbing.ReferenceName) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(name.String(), p) {
+				return true
+			}
+		}
+		return len(prefixes) == 0
+	}
+
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD && match(ref.Name()) {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+	if head, err := repo.Storer.Reference(plumbing.HEAD); err == nil && match(plumbing.HEAD) {
+		refs = append([]*plumbing.Reference{head}, refs...)
+	}
+
+	e := pktline.NewEncoder(w)
+	for _, ref := range refs {
+		resolved, err := storer.ResolveReference(repo.Storer, ref.Name())
+		var line string
+		switch {
+		case err == nil:
+			line = resolved.Hash().String() + " " + ref.Name().String()
+		case err == plumbing.ErrReferenceNotFound && unborn && ref.Name() == plumbing.HEAD:
+			line = "unborn HEAD"
+		case err == plumbing.ErrReferenceNotFound:
+			continue
+		default:
+			return err
+		}
+		if symrefs && ref.Type() == plumbing.SymbolicReference {
+			line += " symref-target:" + ref.Target().String()
+		}
+		if peel && resolved != nil {
+			if peeled := peelTag(repo, resolved.Hash()); peeled != resolved.Hash() {
+				line += " peeled:" + peeled.String()
+			}
+		}
+		if err := e.EncodeString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	return e.Flush()
+}
+
+// peelTag returns the object annotated tags at h point to, or h.
+func peelTag(repo *git.Repository, h plumbing.Hash) plumbing.Hash {
+	for {
+		tag, err := repo.TagObject(h)
+		if err != nil {
+			return h
+		}
+		h = tag.Target
+	}
+}
+
+// fetch answers a v2 fetch. The first round of negotiation is always the
+// last one: the haves we know are acknowledged and the packfile is sent
+// right after.
+func fetch(w io.Writer, repo *git.Repository, args []string) error {
+	req, err := parseFetchArgs(args)
+	if err != nil {
+		return err
+	}
+	plan, err := planFetch(repo, req)
+	if err != nil {
+		return err
+	}
+
+	e := pktline.NewEncoder(w)
+	if !req.Done {
+		if err := writeAcknowledgments(e, plan); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "0001"); err != nil {
+			return err
+		}
+	}
+	if req.deepen() || len(req.Shallows) > 0 {
+		if err := e.EncodeString("shallow-info\n"); err != nil {
+			return err
+		}
+		if err := writeShallowInfo(e, plan); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "0001"); err != nil {
+			return err
+		}
+	}
+
+	objs, err := plan.objects(repo, req)
+	if err != nil {
+		return err
+	}
+	if err := e.EncodeString("packfile\n"); err != nil {
+		return err
+	}
+	pack := packReader(repo, objs, req.OfsDelta)
+	defer pack.Close()
+
+	b := newBandWriter(flushWriter{w})
+	b.quiet = req.NoProgress
+	if err := sendPack(b, pack); err != nil {
+		if ferr := b.fatal(err); ferr != nil {
+			slog.Error("send fatal", "error", ferr.Error())
+		}
+		return err
+	}
+	return b.flush()
+}
+
+func writeAcknowledgments(e *pktline.Encoder, plan *fetchPlan) error {
+	if err := e.EncodeString("acknowledgments\n"); err != nil {
+		return err
+	}
+	if len(plan.Common) == 0 {
+		if err := e.EncodeString("NAK\n"); err != nil {
+			return err
+		}
+	}
+	for _, h := range plan.Common {
+		if err := e.Encodef("ACK %s\n", h); err != nil {
+			return err
+		}
+	}
+	return e.EncodeString("ready\n")
+}
+
+func writeShallowInfo(e *pktline.Encoder, plan *fetchPlan) error {
+	for _, h := range plan.Shallow {
+		if err := e.Encodef("shallow %s\n", h); err != nil {
+			return err
+		}
+	}
+	for _, h := range plan.Unshallow {
+		if err := e.Encodef("unshallow %s\n", h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeUploadRequest reads the lines of a v0 upload-pack request, the
+// capabilities sent with the first want become arguments.
+func decodeUploadRequest(r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+	var args []string
+	for {
+		line, kind, err := readPkt(br)
+		if err == io.EOF {
+			return args, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if kind != pktData {
+			continue
+		}
+		if len(args) == 0 {
+			words := strings.Fields(line)
+			if len(words) < 2 || words[0] != "want" {
+				return nil, &clientError{"expected a want"}
+			}
+			line = words[0] + " " + words[1]
+			for _, c := range words[2:] {
+				switch c {
+				case "side-band-64k", "ofs-delta", "include-tag", "no-progress", "thin-pack", "deepen-relative":
+					args = append(args, c)
+				}
+			}
+		}
+		args = append(args, line)
+		if line == "done" {
+			return args, nil
+		}
+	}
+}
+
+// uploadPack answers a v0 upload-pack request on the repository at repoDir.
+func uploadPack(w http.ResponseWriter, body io.Reader, repoDir string) {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		slog.Error("git PlainOpen", "error", err.Error())
+		http.Error(w, "repository not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	err = uploadPackV0(w, repo, body)
+	sendError(w, "upload pack", err)
+}
+
+// sendError sends errors caused by the request to the client in an ERR
+// packet, git shows them to the user, others are only logged.
+func sendError(w io.Writer, op string, err error) {
+	var ce *clientError
+	if errors.As(err, &ce) {
+		if err := pktline.NewEncoder(w).Encodef("ERR %s\n", ce.msg); err != nil {
+			slog.Error(op, "error", err.Error())
+		}
+		return
+	}
+	if err != nil {
+		slog.Error(op, "error", err.Error())
+	}
+}
+
+// uploadPackV0 answers a v0 request. Over HTTP clients send all their state
+// on every request, a round without done only gets the shallow update and
+// the acknowledgment, without multi_ack that is the first common commit.
+func uploadPackV0(w io.Writer, repo *git.Repository, body io.Reader) error {
+	args, err := decodeUploadRequest(body)
+	if err != nil {
+		return err
+	}
+	req, err := parseFetchArgs(args)
+	if err != nil {
+		return err
+	}
+	slog.Debug("request", "wants", req.Wants, "haves", req.Haves, "depth", req.Depth)
+
+	var plan *fetchPlan
+	if req.Done || req.deepen() {
+		if plan, err = planFetch(repo, req); err != nil {
+			return err
+		}
+	} else {
+		plan = &fetchPlan{Common: commonHaves(repo, req.Haves)}
+	}
+
+	e := pktline.NewEncoder(w)
+	if req.deepen() {
+		if err := writeShallowInfo(e, plan); err != nil {
+			return err
+		}
+		if err := e.Flush(); err != nil {
+			return err
+		}
+		if len(req.Haves) == 0 && !req.Done {
+			// the first request of a shallow fetch
+			return nil
+		}
+	}
+	if len(plan.Common) > 0 {
+		err = e.Encodef("ACK %s\n", plan.Common[0])
+	} else {
+		err = e.EncodeString("NAK\n")
+	}
+	if err != nil || !req.Done {
+		return err
+	}
+
+	objs, err := plan.objects(repo, req)
+	if err != nil {
+		return err
+	}
+	pack := packReader(repo, objs, req.OfsDelta)
+	defer pack.Close()
+	if !req.Sideband {
+		_, err := io.Copy(flushWriter{w}, pack)
+		return err
+	}
+
+	b := newBandWriter(flushWriter{w})
+	b.quiet = req.NoProgress
+	if err := sendPack(b, pack); err != nil {
+		if ferr := b.fatal(err); ferr != nil {
+			slog.Error("send fatal", "error", ferr.Error())
+		}
+		return err
+	}
+	return b.flush()
+}
@@ -0,0 +1,358 @@
+package gwi
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// testGit runs the git client in dir, isolated from the user configuration.
+func testGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(
+		os.Environ(),
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_TERMINAL_PROMPT=0",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %s\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+func Test_Protocol(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	first := testCommit(t, repo, map[string]string{"README.md": "# Hi\n", "src/a.go": "package a\n"}, "init")
+	_, err := repo.CreateTag("v1", first, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "tester", Email: "tester@localhost"},
+		Message: "v1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(g.Handle())
+	defer srv.Close()
+	url := srv.URL + "/x/proj"
+
+	for _, version := range []string{"0", "2"} {
+		t.Run("v"+version, func(t *testing.T) {
+			work := t.TempDir()
+			proto := "protocol.version=" + version
+
+			head, _ := repo.Head()
+			testGit(t, work, "-c", proto, "clone", url, "clone")
+			clone := path.Join(work, "clone")
+			if out := testGit(t, clone, "rev-parse", "HEAD"); strings.TrimSpace(out) != head.Hash().String() {
+				t.Fatalf("cloned %s, want %s", out, head.Hash())
+			}
+			if out := testGit(t, clone, "rev-parse", "v1^{}"); strings.TrimSpace(out) != first.String() {
+				t.Errorf("tag not fetched: %s", out)
+			}
+
+			cmd := exec.Command("git", "-c", proto, "ls-remote", url, "refs/heads/main")
+			cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null", "GIT_TRACE_PACKET=1")
+			traced, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("ls-remote: %s\n%s", err, traced)
+			}
+			if (version == "2") != strings.Contains(string(traced), "< version 2") {
+				t.Errorf("protocol v%s not used:\n%s", version, traced)
+			}
+			out := testGit(t, work, "-c", proto, "ls-remote", url, "refs/heads/main")
+			if out != head.Hash().String()+"\trefs/heads/main\n" {
+				t.Errorf("ls-remote: %q", out)
+			}
+
+			// the client has the previous commits
+			next := testCommit(t, repo, map[string]string{"README.md": "# Hello v" + version + "\n"}, "update")
+			out = testGit(t, clone, "-c", proto, "pull", "--ff-only")
+			if data, _ := os.ReadFile(path.Join(clone, "README.md")); string(data) != "# Hello v"+version+"\n" {
+				t.Errorf("pull: %q\n%s", data, out)
+			}
+			if out := testGit(t, clone, "rev-parse", "HEAD"); strings.TrimSpace(out) != next.String() {
+				t.Errorf("pulled %s, want %s", out, next)
+			}
+		})
+	}
+
+	// pushes always use receive-pack of v0
+	work := t.TempDir()
+	testGit(t, work, "-c", "protocol.version=2", "clone", url, "clone")
+	clone := path.Join(work, "clone")
+	os.WriteFile(path.Join(clone, "b.go"), []byte("package a\n"), 0o644)
+	testGit(t, clone, "add", ".")
+	testGit(t, clone, "-c", "user.name=x", "-c", "user.email=x@localhost", "commit", "-m", "add b")
+	pushURL := strings.Replace(url, "://", "://x:1234@", 1)
+	testGit(t, clone, "-c", "protocol.version=2", "push", pushURL, "main")
+
+	want := strings.TrimSpace(testGit(t, clone, "rev-parse", "HEAD"))
+	r, err := git.PlainOpen(path.Join(root, "x", "proj"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := r.Reference(plumbing.NewBranchReferenceName("main"), true)
+	if err != nil || ref.Hash().String() != want {
+		t.Errorf("push: %v %v, want %s", ref, err, want)
+	}
+	if _, err := r.CommitObject(ref.Hash()); err != nil {
+		t.Errorf("pushed commit: %v", err)
+	}
+}
+
+func Test_ShallowPartial(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	first := testCommit(t, repo, map[string]string{"README.md": "one\n", "old.txt": "old\n"}, "one")
+	if _, err := repo.CreateTag("v1", first, nil); err != nil {
+		t.Fatal(err)
+	}
+	testCommit(t, repo, map[string]string{"README.md": "two\n", "dir/a.txt": "a\n"}, "two")
+	head := testCommit(t, repo, map[string]string{"README.md": "three\n", "dir/a.txt": "a\n"}, "three")
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(g.Handle())
+	defer srv.Close()
+	url := srv.URL + "/x/proj"
+
+	count := func(dir string) string {
+		return strings.TrimSpace(testGit(t, dir, "rev-list", "--count", "HEAD"))
+	}
+	missing := func(dir string) int {
+		out := testGit(t, dir, "rev-list", "--objects", "--all", "--missing=print")
+		return strings.Count(out, "\n?")
+	}
+
+	for _, version := range []string{"0", "2"} {
+		t.Run("v"+version, func(t *testing.T) {
+			work := t.TempDir()
+			proto := "protocol.version=" + version
+			clone := path.Join(work, "depth")
+
+			testGit(t, work, "-c", proto, "clone", "--depth=1", url, "depth")
+			if n := count(clone); n != "1" {
+				t.Errorf("depth 1 clone has %s commits", n)
+			}
+			shallow, _ := os.ReadFile(path.Join(clone, ".git", "shallow"))
+			if string(shallow) != head.String()+"\n" {
+				t.Errorf("shallow commits %q", shallow)
+			}
+			testGit(t, clone, "-c", proto, "fetch", "--deepen=1")
+			if n := count(clone); n != "2" {
+				t.Errorf("deepened clone has %s commits", n)
+			}
+			testGit(t, clone, "-c", proto, "fetch", "--unshallow")
+			if n := count(clone); n != "3" {
+				t.Errorf("unshallowed clone has %s commits", n)
+			}
+			testGit(t, clone, "fsck")
+
+			testGit(t, work, "-c", proto, "clone", "--shallow-exclude=v1", url, "exclude")
+			if n := count(path.Join(work, "exclude")); n != "2" {
+				t.Errorf("clone excluding v1 has %s commits", n)
+			}
+
+			testGit(t, work, "-c", proto, "clone", "--filter=blob:none", url, "blobless")
+			blobless := path.Join(work, "blobless")
+			if data, _ := os.ReadFile(path.Join(blobless, "README.md")); string(data) != "three\n" {
+				t.Errorf("blobless checkout: %q", data)
+			}
+			if n := missing(blobless); n != 3 {
+				t.Errorf("blobless clone misses %d objects, want the old blobs", n)
+			}
+			if out := testGit(t, blobless, "show", first.String()+":old.txt"); out != "old\n" {
+				t.Errorf("lazy fetch of a blob: %q", out)
+			}
+
+			testGit(t, work, "-c", proto, "clone", "--no-checkout", "--filter=tree:0", url, "treeless")
+			if n := missing(path.Join(work, "treeless")); n == 0 {
+				t.Error("treeless clone has all objects")
+			}
+		})
+	}
+}
+
+func Test_DeepenSince(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var hashes []plumbing.Hash
+	for i := 0; i < 4; i++ {
+		sig := object.Signature{Name: "tester", When: start.AddDate(0, 0, i)}
+		commit := &object.Commit{Author: sig, Committer: sig, Message: "day", TreeHash: plumbing.ZeroHash}
+		tree := repo.Storer.NewEncodedObject()
+		if err := (&object.Tree{}).Encode(tree); err != nil {
+			t.Fatal(err)
+		}
+		commit.TreeHash, _ = repo.Storer.SetEncodedObject(tree)
+		if i > 0 {
+			commit.ParentHashes = []plumbing.Hash{hashes[i-1]}
+		}
+		obj := repo.Storer.NewEncodedObject()
+		if err := commit.Encode(obj); err != nil {
+			t.Fatal(err)
+		}
+		h, err := repo.Storer.SetEncodedObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", hashes[3])); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &fetchRequest{Wants: hashes[3:], Since: start.AddDate(0, 0, 2), Filter: noFilter}
+	plan, err := planFetch(repo, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan.Commits, []plumbing.Hash{hashes[3], hashes[2]}) ||
+		!reflect.DeepEqual(plan.Shallow, []plumbing.Hash{hashes[2]}) {
+		t.Errorf("since day 2: commits %v shallow %v", plan.Commits, plan.Shallow)
+	}
+
+	// the client has day 2 as shallow and deepens to day 1
+	req = &fetchRequest{
+		Wants:    hashes[3:],
+		Haves:    hashes[3:],
+		Shallows: hashes[2:3],
+		Since:    start.AddDate(0, 0, 1),
+		Filter:   noFilter,
+	}
+	if plan, err = planFetch(repo, req); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan.Commits, []plumbing.Hash{hashes[1]}) ||
+		!reflect.DeepEqual(plan.Shallow, []plumbing.Hash{hashes[1]}) ||
+		!reflect.DeepEqual(plan.Unshallow, []plumbing.Hash{hashes[2]}) {
+		t.Errorf("deepen to day 1: commits %v shallow %v unshallow %v", plan.Commits, plan.Shallow, plan.Unshallow)
+	}
+	objs, err := plan.objects(repo, req)
+	if err != nil || len(objs) != 1 || objs[0] != hashes[1] {
+		t.Errorf("objects %v %v, want only day 1, its tree is known", objs, err)
+	}
+}
+
+func Test_CheckWants(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	first := testCommit(t, repo, map[string]string{"README.md": "one\n", "old.txt": "old\n"}, "one")
+	second := testCommit(t, repo, map[string]string{"README.md": "two\n"}, "two")
+
+	g := Gwi{config: Config{Root: root}}
+	if err := g.ForkRepo("x", "proj", "y"); err != nil {
+		t.Fatal(err)
+	}
+	// the fork borrows the objects of commits pushed to its parent later
+	third := testCommit(t, repo, map[string]string{"README.md": "three\n"}, "three")
+	fork, err := git.PlainOpen(path.Join(root, "y", "proj"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := repo.CommitObject(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := old.File("old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		repo *git.Repository
+		want plumbing.Hash
+		ok   bool
+	}{
+		{repo, third, true},
+		{repo, first, true},
+		{repo, blob.Hash, true},
+		{repo, plumbing.NewHash("0123456789012345678901234567890123456789"), false},
+		{fork, second, true},
+		{fork, third, false},
+	} {
+		err := checkWants(tt.repo, []plumbing.Hash{tt.want})
+		if (err == nil) != tt.ok {
+			t.Errorf("want %s: %v", tt.want, err)
+		}
+	}
+
+	// an incremental fetch only sends the objects that changed
+	req := &fetchRequest{Wants: []plumbing.Hash{third}, Haves: []plumbing.Hash{second}, Filter: noFilter}
+	plan, err := planFetch(repo, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := plan.objects(repo, req)
+	if err != nil || len(objs) != 3 {
+		t.Errorf("objects %v %v, want the commit, its tree and README.md", objs, err)
+	}
+}
+
+// failWriter fails every write after the first n.
+type failWriter struct {
+	n, writes int
+}
+
+func (f *failWriter) Write(p []byte) (int, error) {
+	f.writes++
+	if f.writes > f.n {
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+func Test_FetchWriteError(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	first := testCommit(t, repo, map[string]string{"README.md": "one\n"}, "one")
+	second := testCommit(t, repo, map[string]string{"README.md": "two\n"}, "two")
+	args := []string{"want " + second.String(), "have " + first.String(), "deepen 1"}
+
+	ok := &failWriter{n: 1 << 30}
+	if err := fetch(ok, repo, args); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < ok.writes; n++ {
+		w := &failWriter{n: n}
+		if err := fetch(w, repo, args); err == nil {
+			t.Errorf("write %d failed but fetch succeeded", n+1)
+		}
+		// only the error band may still be tried once the pack started
+		if w.writes > n+2 {
+			t.Errorf("fetch kept writing after write %d failed", n+1)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package gwi
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"log/slog"
+
+	"github.com/gorilla/mux"
+)
+
+// rawHandler serves the content of a file at the commit given by the ref
+// parameter. HTML and other active content is sent as plain text, so files
+// cannot run scripts on the site.
+func (g *Gwi) rawHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	slog.Debug("running raw handler", "vars", vars)
+
+	if !g.readable(w, r, vars["user"], vars["repo"]) {
+		return
+	}
+
+	repoDir := path.Join(g.config.Root, vars["user"], vars["repo"])
+	repo, err := repos.open(repoDir)
+	if err != nil {
+		g.httpError(w, r, err)
+		return
+	}
+	defer repo.close()
+	commit, immutable, err := resolveOwnRef(repo, r.URL.Query().Get("ref"))
+	if err != nil {
+		g.httpError(w, r, ErrBadRef)
+		return
+	}
+	file, err := commit.File(vars["path"])
+	if err != nil {
+		g.httpError(w, r, err)
+		return
+	}
+
+	modified := time.Time{}
+	if immutable {
+		modified = commit.Committer.When
+	}
+	// blobs are addressed by content, so the hash is a valid entity tag
+	if cacheHeaders(w, r, `"`+file.Hash.String()+`"`, modified, immutable, isPrivate(repoDir)) {
+		return
+	}
+
+	content, err := file.Contents()
+	if err != nil {
+		g.httpError(w, r, err)
+		return
+	}
+	if obj, ok := parseLFSPointer([]byte(content)); ok {
+		if serveLFSObject(w, file.Name, lfsPath(repoDir, obj.OID)) {
+			return
+		}
+	}
+	w.Header().Set("Content-Type", rawContentType(file.Name, []byte(content)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write([]byte(content))
+}
+
+// serveLFSObject sends the object a pointer file refers to, it returns
+// false if the object is not stored, so the pointer is shown instead.
+func serveLFSObject(w http.ResponseWriter, name, file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	w.Header().Set("Content-Type", rawContentType(name, head[:n]))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(head[:n])
+	if _, err := io.Copy(w, f); err != nil {
+		slog.Error("copy lfs object", "error", err.Error())
+	}
+	return true
+}
+
+func rawContentType(name string, content []byte) string {
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = http.DetectContentType(content)
+	}
+
+	media, _, _ := mime.ParseMediaType(ctype)
+	switch {
+	case isBinary(content):
+		return ctype
+	case strings.HasPrefix(media, "text/"), media == "image/svg+xml",
+		strings.HasSuffix(media, "javascript"), strings.HasSuffix(media, "xml"),
+		strings.HasSuffix(media, "json"):
+		return "text/plain; charset=utf-8"
+	}
+	return ctype
+}
@@ -0,0 +1,213 @@
+package gwi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Limits for searches, files bigger than searchMaxFileSize are skipped and
+// searches stop at searchMaxMatches, after searchMaxBytes are read or after
+// searchTimeout. In those cases the result is marked as truncated.
+const (
+	searchTimeout     = 5 * time.Second
+	searchMaxFileSize = 1 << 20
+	searchMaxBytes    = 64 << 20
+	searchMaxMatches  = 500
+	searchContext     = 2
+)
+
+var errSearchLimit = errors.New("search limit reached")
+
+// SearchOptions selects what a search looks for. Pattern is a literal string
+// unless Regex is set. Path, if given, filters the files searched: a plain
+// string selects the files under that path, and a pattern with wildcards, as
+// in [path.Match], is matched against the full name if it has a slash, or
+// against the base name otherwise.
+type SearchOptions struct {
+	Pattern    string
+	Regex      bool
+	IgnoreCase bool
+	Path       string
+}
+
+// SearchMatch is a line that matched a search, with the lines around it.
+type SearchMatch struct {
+	File   string
+	Line   int
+	Text   string
+	Before []string
+	After  []string
+}
+
+// SearchResult holds the matches of a search, Files is the number of files
+// searched. Error tells why the search could not run, e.g. an invalid regex.
+type SearchResult struct {
+	Options   SearchOptions
+	Matches   []SearchMatch
+	Files     int
+	Truncated bool
+	Error     string
+}
+
+// searchOptions reads the options of a search from the query of a request:
+// q is the pattern, path the path filter, and regex and icase turn on the
+// respective options if not empty.
+func searchOptions(query url.Values) SearchOptions {
+	return SearchOptions{
+		Pattern:    query.Get("q"),
+		Regex:      query.Get("regex") != "",
+		IgnoreCase: query.Get("icase") != "",
+		Path:       query.Get("path"),
+	}
+}
+
+func (o SearchOptions) regexp() (*regexp.Regexp, error) {
+	expr := o.Pattern
+	if !o.Regex {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if o.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+func (o SearchOptions) matchPath(name string) bool {
+	if o.Path == "" {
+		return true
+	}
+	if !strings.ContainsAny(o.Path, "*?[") {
+		dir := strings.TrimSuffix(o.Path, "/")
+		return name == dir || strings.HasPrefix(name, dir+"/")
+	}
+	if !strings.Contains(o.Path, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(o.Path, name)
+	return ok
+}
+
+// searchTree greps the files of tree.
+func searchTree(tree *object.Tree, opts SearchOptions) SearchResult {
+	res := SearchResult{Options: opts}
+	if opts.Pattern == "" {
+		return res
+	}
+	re, err := opts.regexp()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	deadline := time.Now().Add(searchTimeout)
+	read := int64(0)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if time.Now().After(deadline) || read > searchMaxBytes {
+			return errSearchLimit
+		}
+		if !f.Mode.IsFile() || !opts.matchPath(f.Name) || f.Size > searchMaxFileSize {
+			return nil
+		}
+
+		r, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(r, searchMaxFileSize))
+		r.Close()
+		if err != nil {
+			return err
+		}
+		read += int64(len(data))
+		if isBinary(data) {
+			return nil
+		}
+
+		res.Files++
+		return searchFile(&res, f.Name, data, re)
+	})
+	if err == errSearchLimit {
+		res.Truncated = true
+	} else if err != nil {
+		slog.Error("search", "error", err.Error())
+		res.Error = "search failed"
+	}
+	return res
+}
+
+// isBinary uses the same heuristic as git: a file is binary if there is a
+// NUL byte in its first 8000 bytes.
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+func searchFile(res *SearchResult, name string, data []byte, re *regexp.Regexp) error {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, searchMaxFileSize)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	for i, l := range lines {
+		if !re.MatchString(l) {
+			continue
+		}
+		if len(res.Matches) == searchMaxMatches {
+			return errSearchLimit
+		}
+		res.Matches = append(res.Matches, SearchMatch{
+			File:   name,
+			Line:   i + 1,
+			Text:   l,
+			Before: lines[max(0, i-searchContext):i],
+			After:  lines[i+1 : min(len(lines), i+1+searchContext)],
+		})
+	}
+	return nil
+}
+
+// search greps the files of the commit ref, or of HEAD if ref is zero,
+// options are read from query, see [SearchOptions].
+func (g *Gwi) search(repo *git.Repository) func(ref plumbing.Hash, query url.Values) SearchResult {
+	return func(ref plumbing.Hash, query url.Values) SearchResult {
+		opts := searchOptions(query)
+		slog.Debug("searching", "ref", ref.String(), "options", opts)
+		if ref.IsZero() {
+			head, err := repo.Head()
+			if err != nil {
+				slog.Error("head", "error", err.Error())
+				return SearchResult{Options: opts, Error: "repository is empty"}
+			}
+			ref = head.Hash()
+		}
+
+		commit, err := repo.CommitObject(ref)
+		if err != nil {
+			slog.Error("commit", "error", err.Error())
+			return SearchResult{Options: opts, Error: "commit not found"}
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			slog.Error("tree", "error", err.Error())
+			return SearchResult{Options: opts, Error: "tree not found"}
+		}
+		return searchTree(tree, opts)
+	}
+}
@@ -0,0 +1,66 @@
+package gwi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func Test_Search(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	testCommit(t, repo, map[string]string{
+		"main.go":     "package main\n\n// Hello greets\nfunc Hello() {}\n",
+		"src/util.go": "package src\n\nfunc hello() {}\n",
+		"README":      "Say hello\n",
+		"data.bin":    "hello\x00world\n",
+	}, "init")
+
+	search := (&Gwi{}).search(repo)
+	tests := []struct {
+		query url.Values
+		want  []string
+	}{
+		{url.Values{"q": {"Hello"}}, []string{"main.go:3", "main.go:4"}},
+		{url.Values{"q": {"hello"}, "icase": {"on"}}, []string{"README:1", "main.go:3", "main.go:4", "src/util.go:3"}},
+		{url.Values{"q": {`^func \w+\(`}, "regex": {"on"}}, []string{"main.go:4", "src/util.go:3"}},
+		{url.Values{"q": {"func"}, "path": {"src"}}, []string{"src/util.go:3"}},
+		{url.Values{"q": {"package"}, "path": {"*.go"}}, []string{"main.go:1", "src/util.go:1"}},
+		{url.Values{"q": {"func("}}, nil},
+	}
+	for _, tt := range tests {
+		res := search(plumbing.ZeroHash, tt.query)
+		var got []string
+		for _, m := range res.Matches {
+			got = append(got, m.File+":"+strconv.Itoa(m.Line))
+		}
+		if !reflect.DeepEqual(got, tt.want) || res.Error != "" {
+			t.Errorf("%v: got %v %q, want %v", tt.query, got, res.Error, tt.want)
+		}
+	}
+
+	res := search(plumbing.ZeroHash, url.Values{"q": {"Hello()"}})
+	m := res.Matches[0]
+	if m.Text != "func Hello() {}" || !reflect.DeepEqual(m.Before, []string{"", "// Hello greets"}) || len(m.After) != 0 {
+		t.Errorf("unexpected context %+v", m)
+	}
+	if res := search(plumbing.ZeroHash, url.Values{"q": {"("}, "regex": {"on"}}); res.Error == "" {
+		t.Error("invalid regex gave no error")
+	}
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/x/proj/search?q=greets", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "main.go:3") {
+		t.Errorf("search page: %d\n%s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,116 @@
+package gwi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+)
+
+// progressInterval is the minimum time between progress messages.
+const progressInterval = time.Second
+
+// useSideband tells whether the client asked for side-band-64k and removes
+// it from caps, the sessions don't know about it as multiplexing is done
+// by the handlers.
+func useSideband(caps *capability.List) bool {
+	if !caps.Supports(capability.Sideband64k) {
+		return false
+	}
+	caps.Delete(capability.Sideband64k)
+	return true
+}
+
+// bandWriter multiplexes a response, writes go to the data band, progress
+// and error messages are shown by git to the user. Progress is not sent if
+// quiet is set.
+type bandWriter struct {
+	w     io.Writer
+	mux   *sideband.Muxer
+	quiet bool
+}
+
+func newBandWriter(w io.Writer) *bandWriter {
+	return &bandWriter{w: w, mux: sideband.NewMuxer(sideband.Sideband64k, w)}
+}
+
+func (b *bandWriter) Write(p []byte) (int, error) {
+	return b.mux.Write(p)
+}
+
+func (b *bandWriter) progress(format string, args ...any) error {
+	if b.quiet {
+		return nil
+	}
+	_, err := b.mux.WriteChannel(sideband.ProgressMessage, []byte(fmt.Sprintf(format, args...)))
+	return err
+}
+
+// fatal sends err to the client, which aborts.
+func (b *bandWriter) fatal(err error) error {
+	_, err = b.mux.WriteChannel(sideband.ErrorMessage, []byte(err.Error()+"\n"))
+	return err
+}
+
+// flush ends the response.
+func (b *bandWriter) flush() error {
+	return pktline.NewEncoder(b.w).Flush()
+}
+
+// sendPack streams a packfile on the data band, telling the client how many
+// objects it has and how much was sent.
+func sendPack(b *bandWriter, pack io.Reader) error {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(pack, header); err != nil {
+		return err
+	}
+	objects := binary.BigEndian.Uint32(header[8:])
+	if err := b.progress("Counting objects: %d, done.\n", objects); err != nil {
+		return err
+	}
+	if _, err := b.Write(header); err != nil {
+		return err
+	}
+
+	sent := int64(len(header))
+	last := time.Now()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := pack.Read(buf)
+		if n > 0 {
+			if _, err := b.Write(buf[:n]); err != nil {
+				return err
+			}
+			sent += int64(n)
+			if time.Since(last) >= progressInterval {
+				if err := b.progress("Sending objects: %s\r", byteSize(sent)); err != nil {
+					return err
+				}
+				last = time.Now()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.progress("Total %d objects, %s, done.\n", objects, byteSize(sent))
+}
+
+func byteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
@@ -0,0 +1,99 @@
+package gwi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+)
+
+func Test_Sideband(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	head := testCommit(t, repo, map[string]string{"README.md": "# Hi\n"}, "init")
+
+	g, err := NewFromConfig(Config{Root: root, PagesRoot: "templates"}, testVault())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/x/proj/info/refs?service=git-upload-pack", nil))
+	if !strings.Contains(rec.Body.String(), "side-band-64k") {
+		t.Errorf("side-band-64k not advertised: %q", rec.Body.String())
+	}
+
+	upr := packp.NewUploadPackRequest()
+	upr.Wants = append(upr.Wants, head)
+	upr.Capabilities.Set(capability.Sideband64k)
+	buf := bytes.Buffer{}
+	if err := upr.UploadRequest.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(&buf, "0009done\n")
+
+	rec = httptest.NewRecorder()
+	g.Handle().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/x/proj/git-upload-pack", &buf))
+	body := bufio.NewReader(rec.Body)
+	res := packp.ServerResponse{}
+	if err := res.Decode(body, false); err != nil {
+		t.Fatal(err)
+	}
+	progress := bytes.Buffer{}
+	demux := sideband.NewDemuxer(sideband.Sideband64k, body)
+	demux.Progress = &progress
+	pack, err := io.ReadAll(demux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pack, []byte("PACK")) {
+		t.Errorf("pack not sent on band 1: %q", pack[:min(len(pack), 16)])
+	}
+	if !strings.Contains(progress.String(), "Counting objects: 3, done.") {
+		t.Errorf("unexpected progress %q", progress.String())
+	}
+
+	// a rejected update is explained on band 2
+	upd := packp.NewReferenceUpdateRequest()
+	upd.Capabilities.Set(capability.ReportStatus)
+	upd.Capabilities.Set(capability.Sideband64k)
+	upd.Commands = append(upd.Commands, &packp.Command{
+		Name: "refs/heads/nope",
+		Old:  head,
+		New:  head,
+	})
+	buf.Reset()
+	if err := upd.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	emptyPack := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00")
+	sum := sha1.Sum(emptyPack)
+	buf.Write(append(emptyPack, sum[:]...))
+	req := httptest.NewRequest(http.MethodPost, "/x/proj/git-receive-pack", &buf)
+	req.SetBasicAuth("x", "1234")
+	rec = httptest.NewRecorder()
+	g.Handle().ServeHTTP(rec, req)
+
+	progress.Reset()
+	demux = sideband.NewDemuxer(sideband.Sideband64k, rec.Body)
+	demux.Progress = &progress
+	report := packp.NewReportStatus()
+	if err := report.Decode(demux); err != nil {
+		t.Fatal(err)
+	}
+	if report.Error() == nil || !strings.Contains(progress.String(), "refs/heads/nope not updated") {
+		t.Errorf("rejection not reported: %+v %q", report, progress.String())
+	}
+	if _, err := repo.Reference(plumbing.ReferenceName("refs/heads/nope"), false); err == nil {
+		t.Error("rejected ref was created")
+	}
+}
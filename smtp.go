@@ -0,0 +1,357 @@
+package gwi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"log/slog"
+)
+
+// defaultMailSize is the biggest message accepted when Config.MailMaxSize is
+// not set.
+const defaultMailSize = 10 << 20
+
+const smtpTimeout = 5 * time.Minute
+
+var (
+	errMailDomain = errors.New("unknown domain")
+	errMailRepo   = errors.New("unknown repository")
+	errMailSize   = errors.New("message too big")
+)
+
+// serveMail accepts SMTP connections on l, messages sent to repo@Domain or
+// user/repo@Domain are stored on the mailing list of the repository. It
+// returns when l is closed.
+func (g *Gwi) serveMail(l net.Listener) error {
+	slog.Info("listening for mail", "address", l.Addr().String())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go g.smtpSession(conn)
+	}
+}
+
+func (g *Gwi) mailMaxSize() int64 {
+	if g.config.MailMaxSize > 0 {
+		return g.config.MailMaxSize
+	}
+	return defaultMailSize
+}
+
+// mailAllowed checks the sender against Config.MailAllowlist, entries are
+// full addresses or domains starting with @. An empty list allows everyone.
+func (g *Gwi) mailAllowed(from string) bool {
+	if len(g.config.MailAllowlist) == 0 {
+		return true
+	}
+	from = strings.ToLower(from)
+	for _, a := range g.config.MailAllowlist {
+		a = strings.ToLower(a)
+		if from == a || strings.HasPrefix(a, "@") && strings.HasSuffix(from, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedRelay checks the address of a client against
+// Config.MailTrustedRelays, entries are IP addresses or networks like
+// 10.0.0.0/8.
+func (g *Gwi) trustedRelay(remote net.Addr) bool {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, r := range g.config.MailTrustedRelays {
+		if _, network, err := net.ParseCIDR(r); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if ip.Equal(net.ParseIP(r)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mailRepo finds the repository an address points to, the local part is
+// either user/repo, with the groups of the repository if any, or just repo,
+// in the latter case the repo name must be unique among all users.
+func (g *Gwi) mailRepo(addr string) (string, error) {
+	local, domain, ok := strings.Cut(addr, "@")
+	if !ok || !strings.EqualFold(domain, g.config.Domain) {
+		return "", errMailDomain
+	}
+
+	if i := strings.LastIndex(local, "/"); i >= 0 {
+		dir, err := g.repoDir(local[:i], local[i+1:])
+		if err != nil {
+			return "", errMailRepo
+		}
+		return dir, nil
+	}
+
+	found := ""
+	eachRepo(g.config.Root, func(user, repo string) {
+		if repo != local {
+			return
+		}
+		if found != "" {
+			// ambiguous
+			found = "-"
+			return
+		}
+		found = path.Join(g.config.Root, user, repo)
+	})
+	if found == "" || found == "-" {
+		return "", errMailRepo
+	}
+	return found, nil
+}
+
+type smtpConn struct {
+	*textproto.Conn
+	conn net.Conn
+}
+
+func (c smtpConn) reply(code int, msg string) {
+	c.conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c.PrintfLine("%d %s", code, msg)
+}
+
+func (g *Gwi) smtpSession(conn net.Conn) {
+	defer conn.Close()
+	c := smtpConn{Conn: textproto.NewConn(conn), conn: conn}
+	remote := conn.RemoteAddr().String()
+	slog.Debug("smtp connection", "remote", remote)
+
+	c.reply(220, g.config.Domain+" gwi ESMTP")
+
+	helo, from := "", ""
+	var rcpts []string
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				slog.Debug("smtp read", "error", err.Error())
+			}
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		arg = strings.TrimSpace(arg)
+
+		switch verb {
+		case "HELO":
+			helo = arg
+			c.reply(250, g.config.Domain)
+		case "EHLO":
+			helo = arg
+			c.PrintfLine("250-%s", g.config.Domain)
+			c.PrintfLine("250-SIZE %d", g.mailMaxSize())
+			c.PrintfLine("250-8BITMIME")
+			c.reply(250, "SMTPUTF8")
+		case "MAIL":
+			if helo == "" {
+				c.reply(503, "send HELO first")
+				continue
+			}
+			addr, params, ok := smtpPath(arg, "FROM:")
+			if !ok {
+				c.reply(501, "syntax: MAIL FROM:<address>")
+				continue
+			}
+			var size int64
+			if _, err := fmt.Sscanf(params["SIZE"], "%d", &size); err == nil && size > g.mailMaxSize() {
+				c.reply(552, errMailSize.Error())
+				continue
+			}
+			if !g.mailAllowed(addr) {
+				slog.Info("smtp sender rejected", "from", addr, "remote", remote)
+				c.reply(550, "sender not allowed")
+				continue
+			}
+			from, rcpts = addr, nil
+			c.reply(250, "ok")
+		case "RCPT":
+			if from == "" {
+				c.reply(503, "send MAIL first")
+				continue
+			}
+			addr, _, ok := smtpPath(arg, "TO:")
+			if !ok {
+				c.reply(501, "syntax: RCPT TO:<address>")
+				continue
+			}
+			repoDir, err := g.mailRepo(addr)
+			if err != nil {
+				c.reply(550, err.Error())
+				continue
+			}
+			rcpts = append(rcpts, repoDir)
+			c.reply(250, "ok")
+		case "DATA":
+			if len(rcpts) == 0 {
+				c.reply(503, "send RCPT first")
+				continue
+			}
+			c.reply(354, "end data with <CR><LF>.<CR><LF>")
+
+			code, msg := g.receiveMail(c, helo, from, rcpts)
+			c.reply(code, msg)
+			from, rcpts = "", nil
+		case "RSET":
+			from, rcpts = "", nil
+			c.reply(250, "ok")
+		case "NOOP":
+			c.reply(250, "ok")
+		case "VRFY":
+			c.reply(252, "cannot verify")
+		case "QUIT":
+			c.reply(221, "bye")
+			return
+		default:
+			c.reply(502, "command not implemented")
+		}
+	}
+}
+
+// smtpPath parses the <address> and parameters of MAIL and RCPT commands.
+func smtpPath(arg, prefix string) (string, map[string]string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, false
+	}
+	end := strings.Index(arg, ">")
+	if end < 0 {
+		return "", nil, false
+	}
+
+	params := map[string]string{}
+	for _, p := range strings.Fields(arg[end+1:]) {
+		k, v, _ := strings.Cut(p, "=")
+		params[strings.ToUpper(k)] = v
+	}
+	return arg[1:end], params, true
+}
+
+// receiveMail reads the message and stores it on the mailing list of every
+// recipient repository, it returns the SMTP reply.
+func (g *Gwi) receiveMail(c smtpConn, helo, from string, rcpts []string) (int, string) {
+	limit := g.mailMaxSize()
+	dot := c.DotReader()
+	data, err := io.ReadAll(io.LimitReader(dot, limit+1))
+	if err != nil {
+		return 451, "error reading message"
+	}
+	if int64(len(data)) > limit {
+		io.Copy(io.Discard, dot)
+		return 552, errMailSize.Error()
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return 554, "invalid message"
+	}
+
+	received := fmt.Sprintf(
+		"Received: from %s by %s with SMTP; %s\r\n",
+		helo,
+		g.config.Domain,
+		time.Now().Format(time.RFC1123Z),
+	)
+	raw := append([]byte(received), data...)
+
+	threads := make([]string, len(rcpts))
+	for i, repoDir := range rcpts {
+		threads[i] = threadFor(repoDir, msg.Header)
+		slog.Info("mail received", "from", from, "repo", repoDir, "thread", threads[i])
+		if err := saveMail(repoDir, threads[i], raw); err != nil {
+			slog.Error("save mail", "error", err.Error())
+			if errors.Is(err, ErrInvalidName) {
+				return 554, "invalid thread name"
+			}
+			return 451, "error saving message"
+		}
+	}
+
+	m, err := parseMail(raw)
+	if err != nil {
+		slog.Error("parse mail", "error", err.Error())
+		return 250, "ok"
+	}
+	relayed := g.trustedRelay(c.conn.RemoteAddr())
+	for i, repoDir := range rcpts {
+		g.runCommands(repoDir, threads[i], m, from, relayed)
+		go g.notifyThread(repoDir, threads[i], m)
+	}
+	return 250, "ok"
+}
+
+// threadFor finds the thread of a message using its In-Reply-To and
+// References headers, if no message they point to is found the thread is
+// given by the subject.
+func threadFor(repoDir string, header mail.Header) string {
+	refs := strings.Fields(header.Get("In-Reply-To") + " " + header.Get("References"))
+	if len(refs) > 0 {
+		ids := messageIDs(repoDir)
+		for _, r := range refs {
+			if thread, ok := ids[strings.Trim(r, "<>")]; ok {
+				return thread
+			}
+		}
+	}
+	return threadName(header.Get("Subject"))
+}
+
+// messageIDs maps the Message-ID of every stored message to its thread.
+func messageIDs(repoDir string) map[string]string {
+	ids := map[string]string{}
+	threads, err := readThreads(repoDir)
+	if err != nil {
+		slog.Error("threads", "error", err.Error())
+	}
+	for _, t := range threads {
+		dir := path.Join(repoDir, mailDir, t.Title)
+		files, err := mailFiles(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			file, err := os.Open(path.Join(dir, f.Name()))
+			if err != nil {
+				continue
+			}
+			header, err := textproto.NewReader(bufio.NewReader(file)).ReadMIMEHeader()
+			file.Close()
+			if err != nil && len(header) == 0 {
+				continue
+			}
+			if id := strings.Trim(header.Get("Message-Id"), "<> "); id != "" {
+				ids[id] = t.Title
+			}
+		}
+	}
+	return ids
+}
@@ -0,0 +1,66 @@
+package gwi
+
+import (
+	"net"
+	"net/smtp"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_SMTP(t *testing.T) {
+	root := t.TempDir()
+	testRepo(t, root, "x", "proj")
+	testRepo(t, root, "y", "proj")
+	testRepo(t, root, "y", "tool")
+
+	g := Gwi{config: Config{
+		Root:          root,
+		Domain:        "localhost",
+		MailMaxSize:   1024,
+		MailAllowlist: []string{"@localhost"},
+	}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go g.serveMail(l)
+	addr := l.Addr().String()
+
+	first := "From: ann@localhost\r\nSubject: Hello\r\nMessage-Id: <1@localhost>\r\n\r\nhi\r\n"
+	reply := "From: bob@localhost\r\nSubject: Re: Hello, again\r\nMessage-Id: <2@localhost>\r\n" +
+		"In-Reply-To: <1@localhost>\r\nReferences: <1@localhost>\r\n\r\nhey\r\n"
+	sends := []struct {
+		from, to, msg string
+		ok            bool
+	}{
+		{"ann@localhost", "x/proj@localhost", first, true},
+		{"bob@localhost", "x/proj@localhost", reply, true},
+		{"bob@localhost", "tool@localhost", first, true},
+		{"bob@localhost", "proj@localhost", first, false},
+		{"bob@localhost", "x/none@localhost", first, false},
+		{"bob@localhost", "x/proj@example.com", first, false},
+		{"eve@example.com", "x/proj@localhost", first, false},
+		{"ann@localhost", "x/proj@localhost", first + strings.Repeat("a", 2048), false},
+	}
+	for _, s := range sends {
+		err := smtp.SendMail(addr, nil, s.from, []string{s.to}, []byte(s.msg))
+		if (err == nil) != s.ok {
+			t.Errorf("send from %s to %s: %v", s.from, s.to, err)
+		}
+	}
+
+	threads, err := readThreads(path.Join(root, "x", "proj"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 1 || threads[0].Title != "Hello" || threads[0].Mails != 2 {
+		t.Errorf("unexpected threads %+v", threads)
+	}
+
+	mails, err := readMails(path.Join(root, "y", "tool"), "Hello")
+	if err != nil || len(mails) != 1 {
+		t.Errorf("tool got %d mails: %v", len(mails), err)
+	}
+}
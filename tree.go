@@ -34,24 +34,26 @@ func (g *Gwi) file(repo *git.Repository) func(ref plumbing.Hash, name string) st
 	}
 }
 
-func (g *Gwi) files(repo *git.Repository) func(ref plumbing.Hash) int {
+func (g *Gwi) files(repo *cachedRepo) func(ref plumbing.Hash) int {
 	return func(ref plumbing.Hash) int {
-		// files
-		slog.Debug("getting commit", "ref", ref.String())
-		commit, err := repo.CommitObject(ref)
-		if err != nil {
-			slog.Error("commit", "error", err.Error())
-			return -1
-		}
+		return repo.memoize("files "+ref.String(), func() any {
+			// files
+			slog.Debug("getting commit", "ref", ref.String())
+			commit, err := repo.CommitObject(ref)
+			if err != nil {
+				slog.Error("commit", "error", err.Error())
+				return -1
+			}
 
-		slog.Debug("getting files", "commit", commit.Hash.String())
-		t, err := commit.Tree()
-		if err != nil {
-			slog.Error("trees", "error", err.Error())
-			return -1
-		}
+			slog.Debug("getting files", "commit", commit.Hash.String())
+			t, err := commit.Tree()
+			if err != nil {
+				slog.Error("trees", "error", err.Error())
+				return -1
+			}
 
-		return countFiles(t)
+			return countFiles(t)
+		}).(int)
 	}
 }
 
@@ -0,0 +1,574 @@
+package gwi
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// fetchRequest asks for objects, it is read from the arguments of a v2 fetch
+// or from the lines of a v0 upload-pack request, which are mostly the same.
+// Shallows are the shallow commits of the client, and Depth, Since and Not
+// make the fetch shallow, see git fetch --depth, --shallow-since and
+// --shallow-exclude. Relative counts Depth from the shallow commits of the
+// client, like git fetch --deepen.
+type fetchRequest struct {
+	Wants    []plumbing.Hash
+	Haves    []plumbing.Hash
+	Shallows []plumbing.Hash
+	Depth    int
+	Relative bool
+	Since    time.Time
+	Not      []string
+	Filter   objectFilter
+
+	Done       bool
+	Sideband   bool
+	OfsDelta   bool
+	IncludeTag bool
+	NoProgress bool
+}
+
+// deepen tells whether the request changes the shallow commits of the
+// client.
+func (req *fetchRequest) deepen() bool {
+	return req.Depth > 0 || !req.Since.IsZero() || len(req.Not) > 0
+}
+
+// objectFilter omits objects of a partial clone, see the --filter option of
+// git rev-list. Blobs of BlobLimit bytes or more are omitted, as are trees
+// and blobs at TreeDepth or deeper, the root tree is at depth 0. Negative
+// values don't omit anything.
+type objectFilter struct {
+	BlobLimit int64
+	TreeDepth int
+}
+
+var noFilter = objectFilter{BlobLimit: -1, TreeDepth: -1}
+
+func parseFilter(spec string) (objectFilter, error) {
+	f := noFilter
+	kind, value, _ := strings.Cut(spec, ":")
+	switch {
+	case kind == "blob" && value == "none":
+		f.BlobLimit = 0
+		return f, nil
+	case kind == "blob" && strings.HasPrefix(value, "limit="):
+		value = strings.ToLower(strings.TrimPrefix(value, "limit="))
+		unit := int64(1)
+		switch {
+		case strings.HasSuffix(value, "k"):
+			unit = 1 << 10
+		case strings.HasSuffix(value, "m"):
+			unit = 1 << 20
+		case strings.HasSuffix(value, "g"):
+			unit = 1 << 30
+		}
+		n, err := strconv.ParseInt(strings.TrimRight(value, "kmg"), 10, 64)
+		if err == nil && n >= 0 {
+			f.BlobLimit = n * unit
+			return f, nil
+		}
+	case kind == "tree":
+		n, err := strconv.Atoi(value)
+		if err == nil && n >= 0 {
+			f.TreeDepth = n
+			return f, nil
+		}
+	}
+	return f, &clientError{"unsupported filter " + spec}
+}
+
+// parseFetchArgs reads a fetch request, v0 capabilities can be given as
+// arguments.
+func parseFetchArgs(args []string) (*fetchRequest, error) {
+	req := &fetchRequest{Filter: noFilter}
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, " ")
+		switch name {
+		case "want", "have", "shallow":
+			if !isHash(value) {
+				return nil, &clientError{"invalid object " + value}
+			}
+			h := plumbing.NewHash(value)
+			switch name {
+			case "want":
+				req.Wants = append(req.Wants, h)
+			case "have":
+				req.Haves = append(req.Haves, h)
+			default:
+				req.Shallows = append(req.Shallows, h)
+			}
+		case "deepen":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, &clientError{"invalid depth " + value}
+			}
+			req.Depth = n
+		case "deepen-relative":
+			req.Relative = true
+		case "deepen-since":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, &clientError{"invalid deepen-since " + value}
+			}
+			req.Since = time.Unix(n, 0)
+		case "deepen-not":
+			req.Not = append(req.Not, value)
+		case "filter":
+			f, err := parseFilter(value)
+			if err != nil {
+				return nil, err
+			}
+			req.Filter = f
+		case "done":
+			req.Done = true
+		case "side-band-64k":
+			req.Sideband = true
+		case "ofs-delta":
+			req.OfsDelta = true
+		case "include-tag":
+			req.IncludeTag = true
+		case "no-progress":
+			req.NoProgress = true
+		case "thin-pack":
+			// packs are never thin
+		default:
+			return nil, &clientError{"unexpected fetch argument " + arg}
+		}
+	}
+	if len(req.Wants) == 0 {
+		return nil, &clientError{"no wants given"}
+	}
+	return req, nil
+}
+
+// commonHaves returns the haves of the client that are in the repository.
+func commonHaves(repo *git.Repository, haves []plumbing.Hash) []plumbing.Hash {
+	var common []plumbing.Hash
+	for _, h := range haves {
+		if repo.Storer.HasEncodedObject(h) == nil {
+			common = append(common, h)
+		}
+	}
+	return common
+}
+
+// fetchPlan holds the commits sent for a fetch request. Shallow are the
+// commits sent without their parents, and Unshallow the shallow commits of
+// the client whose parents are now sent.
+type fetchPlan struct {
+	Common    []plumbing.Hash
+	Commits   []plumbing.Hash
+	Shallow   []plumbing.Hash
+	Unshallow []plumbing.Hash
+
+	tags []plumbing.Hash
+	objs []plumbing.Hash
+	has  map[plumbing.Hash]bool
+}
+
+// checkWants makes sure every want can be reached from a reference, so
+// clients can't fetch unreachable objects, like the ones a fork borrows from
+// its parent through alternates. Wants are usually references, the history
+// is only walked for the others, and trees only if some want is not a commit.
+func checkWants(repo *git.Repository, wants []plumbing.Hash) error {
+	refs, err := repo.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+	tips := map[plumbing.Hash]bool{}
+	var commits []plumbing.Hash
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		ref, err := storer.ResolveReference(repo.Storer, ref.Name())
+		if err != nil {
+			return nil
+		}
+		h := ref.Hash()
+		tips[h] = true
+		for {
+			tag, err := repo.TagObject(h)
+			if err != nil {
+				break
+			}
+			h = tag.Target
+			tips[h] = true
+		}
+		commits = append(commits, h)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	left := map[plumbing.Hash]bool{}
+	trees := false
+	for _, h := range wants {
+		if tips[h] {
+			continue
+		}
+		obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return &clientError{"not our ref " + h.String()}
+		}
+		left[h] = true
+		trees = trees || obj.Type() != plumbing.CommitObject
+	}
+	if len(left) == 0 {
+		return nil
+	}
+
+	seen := map[plumbing.Hash]bool{}
+	found := func(h plumbing.Hash) {
+		delete(left, h)
+	}
+	var treeErr error
+	err = walkCommits(repo, commits, func(c *object.Commit) bool {
+		delete(left, c.Hash)
+		if trees && len(left) > 0 && treeErr == nil {
+			treeErr = walkTree(repo, c.TreeHash, 0, noFilter, seen, found)
+		}
+		return len(left) > 0 && treeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if treeErr != nil {
+		return treeErr
+	}
+	for h := range left {
+		return &clientError{"not our ref " + h.String()}
+	}
+	return nil
+}
+
+// planFetch walks the history from the wants, up to the commits the client
+// has or to the limits of a shallow fetch. Wants must be reachable from a
+// reference, see checkWants.
+func planFetch(repo *git.Repository, req *fetchRequest) (*fetchPlan, error) {
+	if err := checkWants(repo, req.Wants); err != nil {
+		return nil, err
+	}
+	p := &fetchPlan{Common: commonHaves(repo, req.Haves), has: map[plumbing.Hash]bool{}}
+	clientShallow := map[plumbing.Hash]bool{}
+	for _, h := range req.Shallows {
+		clientShallow[h] = true
+	}
+
+	// the history of the client ends at its shallow commits
+	err := walkCommits(repo, p.Common, func(c *object.Commit) bool {
+		p.has[c.Hash] = true
+		return !clientShallow[c.Hash]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := map[plumbing.Hash]bool{}
+	for _, name := range req.Not {
+		ref, err := resolveDeepenNot(repo, name)
+		if err != nil {
+			return nil, err
+		}
+		err = walkCommits(repo, []plumbing.Hash{ref}, func(c *object.Commit) bool {
+			excluded[c.Hash] = true
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	limit := req.Depth
+	if req.Relative {
+		// the shallow commits of the client are at depth 1
+		limit++
+	}
+	include := func(c *object.Commit, depth int) bool {
+		return (limit == 0 || depth <= limit) &&
+			(req.Since.IsZero() || !c.Committer.When.Before(req.Since)) &&
+			!excluded[c.Hash]
+	}
+
+	// the walk is breadth first, so commits are reached at their lowest
+	// depth, wants can be tags. A relative depth is 0 until the walk goes
+	// past the shallow commits of the client.
+	var queue []*object.Commit
+	depth := map[plumbing.Hash]int{}
+	for _, h := range req.Wants {
+		obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, &clientError{"not our ref " + h.String()}
+		}
+		for obj.Type() == plumbing.TagObject {
+			p.tags = append(p.tags, obj.Hash())
+			tag, err := object.DecodeTag(repo.Storer, obj)
+			if err != nil {
+				return nil, err
+			}
+			if obj, err = repo.Storer.EncodedObject(plumbing.AnyObject, tag.Target); err != nil {
+				return nil, err
+			}
+		}
+		if obj.Type() != plumbing.CommitObject {
+			p.objs = append(p.objs, obj.Hash())
+			continue
+		}
+		if _, ok := depth[obj.Hash()]; ok {
+			continue
+		}
+		c, err := object.DecodeCommit(repo.Storer, obj)
+		if err != nil {
+			return nil, err
+		}
+		depth[c.Hash] = 1
+		if req.Relative {
+			depth[c.Hash] = 0
+		}
+		queue = append(queue, c)
+	}
+
+	parentDepth := func(c plumbing.Hash) int {
+		switch {
+		case req.Relative && clientShallow[c]:
+			return 2
+		case req.Relative && depth[c] == 0:
+			return 0
+		}
+		return depth[c] + 1
+	}
+	deepen := req.deepen()
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if !p.has[c.Hash] {
+			p.Commits = append(p.Commits, c.Hash)
+		}
+		if clientShallow[c.Hash] && !deepen {
+			continue
+		}
+
+		var parents []*object.Commit
+		shallow := false
+		err := c.Parents().ForEach(func(parent *object.Commit) error {
+			if !include(parent, parentDepth(c.Hash)) {
+				shallow = true
+				return storer.ErrStop
+			}
+			parents = append(parents, parent)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if shallow {
+			if !clientShallow[c.Hash] {
+				p.Shallow = append(p.Shallow, c.Hash)
+			}
+			continue
+		}
+		if clientShallow[c.Hash] {
+			p.Unshallow = append(p.Unshallow, c.Hash)
+		}
+
+		for _, parent := range parents {
+			if _, ok := depth[parent.Hash]; ok {
+				continue
+			}
+			// a deepened history can go past commits the client has
+			if p.has[parent.Hash] && !deepen {
+				continue
+			}
+			depth[parent.Hash] = parentDepth(c.Hash)
+			queue = append(queue, parent)
+		}
+	}
+	return p, nil
+}
+
+func resolveDeepenNot(repo *git.Repository, name string) (plumbing.Hash, error) {
+	for _, ref := range []plumbing.ReferenceName{
+		plumbing.ReferenceName(name),
+		plumbing.NewBranchReferenceName(name),
+		plumbing.NewTagReferenceName(name),
+	} {
+		if r, err := storer.ResolveReference(repo.Storer, ref); err == nil {
+			return peelTag(repo, r.Hash()), nil
+		}
+	}
+	return plumbing.ZeroHash, &clientError{"deepen-not is not a ref: " + name}
+}
+
+// walkCommits calls f for every commit reachable from hashes, the parents of
+// a commit are skipped if f returns false. Hashes that are not commits are
+// ignored.
+func walkCommits(repo *git.Repository, hashes []plumbing.Hash, f func(*object.Commit) bool) error {
+	seen := map[plumbing.Hash]bool{}
+	for len(hashes) > 0 {
+		h := hashes[len(hashes)-1]
+		hashes = hashes[:len(hashes)-1]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		c, err := repo.CommitObject(h)
+		if err == plumbing.ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if f(c) {
+			hashes = append(hashes, c.ParentHashes...)
+		}
+	}
+	return nil
+}
+
+// objects lists the objects to send: the commits of the plan, their trees
+// and blobs the filter keeps, and tags. Like git, objects in the trees of the
+// boundary commits, the ones the client has next to the commits sent, are
+// not sent, older commits of the client are not looked at.
+func (p *fetchPlan) objects(repo *git.Repository, req *fetchRequest) ([]plumbing.Hash, error) {
+	commits := make([]*object.Commit, 0, len(p.Commits))
+	boundary := map[plumbing.Hash]bool{}
+	for _, h := range p.Unshallow {
+		boundary[h] = true
+	}
+	for _, h := range p.Commits {
+		c, err := repo.CommitObject(h)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, c)
+		for _, parent := range c.ParentHashes {
+			if p.has[parent] {
+				boundary[parent] = true
+			}
+		}
+	}
+
+	sent := map[plumbing.Hash]bool{}
+	for h := range boundary {
+		c, err := repo.CommitObject(h)
+		if err != nil {
+			return nil, err
+		}
+		if err := walkTree(repo, c.TreeHash, 0, noFilter, sent, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var objs []plumbing.Hash
+	add := func(h plumbing.Hash) {
+		objs = append(objs, h)
+	}
+	for _, h := range append(p.tags, p.Commits...) {
+		sent[h] = true
+		add(h)
+	}
+	for _, c := range commits {
+		if err := walkTree(repo, c.TreeHash, 0, req.Filter, sent, add); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range p.objs {
+		// wanted objects are sent even if the filter omits them
+		if sent[h] {
+			continue
+		}
+		sent[h] = true
+		add(h)
+		tree, err := repo.TreeObject(h)
+		if err == plumbing.ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := walkEntries(repo, tree, 1, req.Filter, sent, add); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.IncludeTag {
+		tags, err := repo.TagObjects()
+		if err != nil {
+			return nil, err
+		}
+		err = tags.ForEach(func(t *object.Tag) error {
+			if sent[t.Target] && !sent[t.Hash] && !p.has[t.Target] {
+				sent[t.Hash] = true
+				add(t.Hash)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return objs, nil
+}
+
+// walkTree calls add for the objects under h, a tree or a blob at depth,
+// that the filter keeps and are not in seen.
+func walkTree(repo *git.Repository, h plumbing.Hash, depth int, f objectFilter, seen map[plumbing.Hash]bool, add func(plumbing.Hash)) error {
+	if seen[h] || f.TreeDepth >= 0 && depth >= f.TreeDepth {
+		return nil
+	}
+	obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, h)
+	if err != nil {
+		return err
+	}
+	if obj.Type() == plumbing.BlobObject {
+		if f.BlobLimit >= 0 && obj.Size() >= f.BlobLimit {
+			return nil
+		}
+		seen[h] = true
+		if add != nil {
+			add(h)
+		}
+		return nil
+	}
+
+	seen[h] = true
+	if add != nil {
+		add(h)
+	}
+	tree, err := object.DecodeTree(repo.Storer, obj)
+	if err != nil {
+		return err
+	}
+	return walkEntries(repo, tree, depth+1, f, seen, add)
+}
+
+// walkEntries calls walkTree for the entries of tree, which are at depth.
+func walkEntries(repo *git.Repository, tree *object.Tree, depth int, f objectFilter, seen map[plumbing.Hash]bool, add func(plumbing.Hash)) error {
+	for _, e := range tree.Entries {
+		if e.Mode == filemode.Submodule {
+			continue
+		}
+		if err := walkTree(repo, e.Hash, depth, f, seen, add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packReader encodes objs in a packfile as it is read.
+func packReader(repo *git.Repository, objs []plumbing.Hash, ofsDelta bool) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := packfile.NewEncoder(pw, repo.Storer, !ofsDelta).Encode(objs, 10)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
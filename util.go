@@ -1,8 +1,11 @@
 package gwi
 
 import (
+	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
 	"log/slog"
 )
@@ -14,3 +17,85 @@ func readDesc(repo string) string {
 	}
 	return string(descBytes)
 }
+
+// displayName is the name of a repository as shown to users, without the
+// .git suffix of its folder.
+func displayName(repo string) string {
+	return strings.TrimSuffix(repo, ".git")
+}
+
+// requestScheme returns the scheme used by the client, which may be behind
+// a proxy.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// cloneURL is the canonical address of the repository, on Config.Domain
+// if set.
+func (g *Gwi) cloneURL(r *http.Request, user, repo string) string {
+	host := g.config.Domain
+	if host == "" {
+		host = r.Host
+	}
+	return requestScheme(r) + "://" + host + "/" + user + "/" + displayName(repo)
+}
+
+// isRepo tells whether dir is a bare repository, other folders under a
+// user are groups.
+func isRepo(dir string) bool {
+	info, err := os.Stat(path.Join(dir, "HEAD"))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// owner returns the user that owns the repositories of namespace, which is
+// its first folder.
+func owner(namespace string) string {
+	user, _, _ := strings.Cut(namespace, "/")
+	return user
+}
+
+// repoPath returns the namespace and name of the repository at repoDir.
+func (g *Gwi) repoPath(repoDir string) (string, string) {
+	rel, err := filepath.Rel(g.config.Root, repoDir)
+	if err != nil {
+		return path.Base(path.Dir(repoDir)), path.Base(repoDir)
+	}
+	namespace, repo := path.Split(filepath.ToSlash(rel))
+	return strings.TrimSuffix(namespace, "/"), repo
+}
+
+// eachRepo calls f with the namespace and name of every repository under
+// root, the namespace is the user followed by the groups the repository is
+// in. Hidden folders are skipped.
+func eachRepo(root string, f func(user, repo string)) {
+	users, err := os.ReadDir(root)
+	if err != nil {
+		slog.Error("readDir", "error", err.Error())
+	}
+	for _, u := range users {
+		if u.IsDir() && !strings.HasPrefix(u.Name(), ".") {
+			eachGroupRepo(root, u.Name(), f)
+		}
+	}
+}
+
+func eachGroupRepo(root, group string, f func(user, repo string)) {
+	entries, err := os.ReadDir(path.Join(root, group))
+	if err != nil {
+		slog.Error("readDir", "error", err.Error())
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if isRepo(path.Join(root, group, e.Name())) {
+			f(group, e.Name())
+			continue
+		}
+		eachGroupRepo(root, group+"/"+e.Name(), f)
+	}
+}
@@ -0,0 +1,304 @@
+package gwi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+// Webhook is an HTTP receiver notified about events on a repository. Hooks
+// are read from the webhooks.json file inside the bare repository, which
+// holds a JSON list of them. Events selects which events are sent, currently
+// push and tag, an empty list means all of them. If Secret is set the payload
+// is signed using HMAC SHA256 and the signature is sent on the
+// X-Gwi-Signature-256 header.
+type Webhook struct {
+	URL    string
+	Secret string
+	Events []string
+}
+
+// WebhookPayload is the JSON body posted to webhooks.
+type WebhookPayload struct {
+	Event   string          `json:"event"`
+	User    string          `json:"user"`
+	Repo    string          `json:"repo"`
+	Refs    []RefUpdate     `json:"refs"`
+	Commits []CommitPayload `json:"commits"`
+}
+
+// RefUpdate describes the change of a reference, Old is the zero hash for
+// created references and New is the zero hash for deleted ones.
+type RefUpdate struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// CommitPayload is the summary of a commit sent on webhook payloads.
+type CommitPayload struct {
+	Hash    string    `json:"hash"`
+	Message string    `json:"message"`
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	Date    time.Time `json:"date"`
+}
+
+// Delivery is one attempt of sending a payload to a webhook, they are
+// appended to the webhooks.log file of the repository as JSON lines.
+type Delivery struct {
+	ID      string
+	URL     string
+	Event   string
+	Attempt int
+	Status  int
+	Error   string
+	Time    time.Time
+}
+
+const (
+	webhooksFile = "webhooks.json"
+	webhooksLog  = "webhooks.log"
+
+	webhookRetries    = 3
+	webhookMaxCommits = 20
+)
+
+var (
+	webhookBackoff = 2 * time.Second
+	webhookClient  = &http.Client{Timeout: 10 * time.Second}
+
+	deliveryMu sync.Mutex
+)
+
+func readWebhooks(repoDir string) ([]Webhook, error) {
+	data, err := os.ReadFile(path.Join(repoDir, webhooksFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []Webhook
+	err = json.Unmarshal(data, &hooks)
+	return hooks, err
+}
+
+func (h Webhook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// sendWebhooks builds the payloads for the updated references and delivers
+// them asynchronously to the webhooks configured for the repository.
+func (g *Gwi) sendWebhooks(user, repo string, cmds []*packp.Command) {
+	repoDir := path.Join(g.config.Root, user, repo)
+	hooks, err := readWebhooks(repoDir)
+	if err != nil {
+		slog.Error("read webhooks", "error", err.Error())
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	gitRepo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		slog.Error("git PlainOpen", "error", err.Error())
+		return
+	}
+
+	payloads := map[string]*WebhookPayload{}
+	for _, c := range cmds {
+		event := "push"
+		if c.Name.IsTag() {
+			event = "tag"
+		}
+		pay := payloads[event]
+		if pay == nil {
+			pay = &WebhookPayload{Event: event, User: user, Repo: repo}
+			payloads[event] = pay
+		}
+
+		pay.Refs = append(
+			pay.Refs,
+			RefUpdate{Name: c.Name.String(), Old: c.Old.String(), New: c.New.String()},
+		)
+		if event == "push" {
+			pay.Commits = append(pay.Commits, newCommits(gitRepo, c.Old, c.New)...)
+		}
+	}
+
+	for _, pay := range payloads {
+		body, err := json.Marshal(pay)
+		if err != nil {
+			slog.Error("marshal payload", "error", err.Error())
+			continue
+		}
+		for _, h := range hooks {
+			if !h.wants(pay.Event) {
+				continue
+			}
+			go deliver(repoDir, h, pay.Event, body)
+		}
+	}
+}
+
+// newCommits lists the commits reachable from new that are not old, only
+// the first parent is followed and at most webhookMaxCommits are returned.
+func newCommits(repo *git.Repository, old, new plumbing.Hash) []CommitPayload {
+	var commits []CommitPayload
+	if new.IsZero() {
+		return commits
+	}
+
+	commit, err := repo.CommitObject(new)
+	for err == nil && commit.Hash != old && len(commits) < webhookMaxCommits {
+		commits = append(commits, CommitPayload{
+			Hash:    commit.Hash.String(),
+			Message: commit.Message,
+			Author:  commit.Author.Name,
+			Email:   commit.Author.Email,
+			Date:    commit.Author.When,
+		})
+		commit, err = commit.Parent(0)
+	}
+	if err != nil && err != object.ErrParentNotFound {
+		slog.Error("commit", "error", err.Error())
+	}
+	return commits
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts body to the webhook, retrying with exponential backoff
+// when the request fails or the receiver does not answer with a 2xx status.
+// Every attempt is recorded in the delivery log.
+func deliver(repoDir string, h Webhook, event string, body []byte) {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	wait := webhookBackoff
+	for attempt := 1; attempt <= webhookRetries; attempt++ {
+		d := Delivery{
+			ID:      hex.EncodeToString(id),
+			URL:     h.URL,
+			Event:   event,
+			Attempt: attempt,
+			Time:    time.Now(),
+		}
+		d.Status, d.Error = post(h, d.ID, event, body)
+		logDelivery(repoDir, d)
+		if d.Error == "" {
+			return
+		}
+
+		slog.Info("webhook delivery", "url", h.URL, "attempt", attempt, "error", d.Error)
+		if attempt < webhookRetries {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+}
+
+func post(h Webhook, id, event string, body []byte) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gwi")
+	req.Header.Set("X-Gwi-Event", event)
+	req.Header.Set("X-Gwi-Delivery", id)
+	if h.Secret != "" {
+		req.Header.Set("X-Gwi-Signature-256", sign(h.Secret, body))
+	}
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Sprintf("unexpected status: %s", res.Status)
+	}
+	return res.StatusCode, ""
+}
+
+func logDelivery(repoDir string, d Delivery) {
+	line, err := json.Marshal(d)
+	if err != nil {
+		slog.Error("marshal delivery", "error", err.Error())
+		return
+	}
+
+	deliveryMu.Lock()
+	defer deliveryMu.Unlock()
+
+	f, err := os.OpenFile(
+		path.Join(repoDir, webhooksLog),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0o600,
+	)
+	if err != nil {
+		slog.Error("open delivery log", "error", err.Error())
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		slog.Error("write delivery log", "error", err.Error())
+	}
+}
+
+// Deliveries returns the recorded webhook deliveries of a repository, in the
+// order they were attempted.
+func (g *Gwi) Deliveries(user, repo string) ([]Delivery, error) {
+	data, err := os.ReadFile(path.Join(g.config.Root, user, repo, webhooksLog))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var deliveries []Delivery
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		d := Delivery{}
+		if err := json.Unmarshal([]byte(line), &d); err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,90 @@
+package gwi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+func Test_Webhooks(t *testing.T) {
+	root := t.TempDir()
+	repo := testRepo(t, root, "x", "proj")
+	first := testCommit(t, repo, map[string]string{"README.md": "hi"}, "first")
+	second := testCommit(t, repo, map[string]string{"README.md": "hello"}, "second")
+
+	type received struct {
+		sig     string
+		event   string
+		payload WebhookPayload
+	}
+	got := make(chan received, 4)
+	fails := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fails > 0 {
+			fails--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		rec := received{
+			sig:   r.Header.Get("X-Gwi-Signature-256"),
+			event: r.Header.Get("X-Gwi-Event"),
+		}
+		if rec.sig != sign("s3cret", body) {
+			t.Error("bad signature", rec.sig)
+		}
+		json.Unmarshal(body, &rec.payload)
+		got <- rec
+	}))
+	defer srv.Close()
+
+	hooks := []Webhook{{URL: srv.URL, Secret: "s3cret", Events: []string{"push"}}}
+	data, _ := json.Marshal(hooks)
+	repoDir := path.Join(root, "x", "proj")
+	if err := os.WriteFile(path.Join(repoDir, webhooksFile), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	backoff := webhookBackoff
+	webhookBackoff = time.Millisecond
+	t.Cleanup(func() { webhookBackoff = backoff })
+	g := Gwi{config: Config{Root: root}}
+	g.sendWebhooks("x", "proj", []*packp.Command{
+		{Name: plumbing.NewBranchReferenceName("main"), Old: first, New: second},
+		{Name: plumbing.NewTagReferenceName("v1"), New: second},
+	})
+
+	var rec received
+	select {
+	case rec = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+	if rec.event != "push" || len(rec.payload.Refs) != 1 {
+		t.Fatalf("unexpected payload %+v", rec)
+	}
+	if len(rec.payload.Commits) != 1 || rec.payload.Commits[0].Hash != second.String() {
+		t.Errorf("unexpected commits %+v", rec.payload.Commits)
+	}
+
+	// the delivery is recorded after the response is read
+	var deliveries []Delivery
+	for deadline := time.Now().Add(5 * time.Second); len(deliveries) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		var err error
+		if deliveries, err = g.Deliveries("x", "proj"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(deliveries) != 2 || deliveries[0].Status != http.StatusBadGateway || deliveries[1].Error != "" {
+		t.Errorf("unexpected deliveries %+v", deliveries)
+	}
+}